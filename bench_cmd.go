@@ -0,0 +1,97 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "io"
+    "math/rand"
+    "os"
+    "strings"
+
+    "nats_app/internal/config"
+    "nats_app/internal/services"
+)
+
+const (
+    CacheBenchCmd string = "cache-bench"
+)
+
+// zipf distributed keys when no recorded trace is given
+func syntheticTrace(accesses int, keys uint64, size int) []services.TraceRecord {
+    zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 1, keys - 1)
+    trace := make([]services.TraceRecord, accesses)
+    for i := range trace {
+        trace[i] = services.TraceRecord{Key: fmt.Sprintf("order-%d", zipf.Uint64()), Size: size}
+    }
+    return trace
+}
+
+// nats_app cache-bench -trace <file|-> [-policies lru,lfu,arc] ...
+// replays key-access trace against each eviction policy,
+// returns process exit code
+func runCacheBench(args []string) int {
+    fs := flag.NewFlagSet(CacheBenchCmd, flag.ContinueOnError)
+    tracePath := fs.String("trace", "", "trace file, one \"<key> [size]\" per line, - for stdin")
+    policies := fs.String("policies", "lru,lfu,arc", "comma separated eviction policies")
+    size := fs.Int("size", 2048, "max cache entries")
+    // byte limit below size * payload, so byte pressure evictions are measured too
+    maxBytes := fs.Int64("max-bytes", 1 << 20, "max payload bytes, 0 - no limit")
+    maxEntryBytes := fs.Int64("max-entry-bytes", 0, "max payload bytes of one entry, 0 - no limit")
+    payload := fs.Int("payload", 1024, "payload size if trace has no size")
+    synthetic := fs.Int("synthetic", 100000, "accesses in synthetic trace, used without -trace")
+    keys := fs.Uint64("keys", 10000, "distinct keys in synthetic trace")
+    if err := fs.Parse(args); err != nil {
+        return 2
+    }
+
+    var trace []services.TraceRecord
+    if *tracePath == "" {
+        if *keys < 2 {
+            fmt.Fprintln(os.Stderr, "Error: -keys must be > 1")
+            return 2
+        }
+        trace = syntheticTrace(*synthetic, *keys, *payload)
+    } else {
+        var r io.Reader = os.Stdin
+        if *tracePath != "-" {
+            f, err := os.Open(*tracePath)
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+                return 1
+            }
+            defer f.Close()
+            r = f
+        }
+        var err error
+        if trace, err = services.ReadTrace(r, *payload); err != nil {
+            fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+            return 1
+        }
+    }
+
+    fmt.Printf("%-6s %10s %10s %10s %10s %8s %12s\n", "policy", "accesses", "hits", "misses", "evictions", "ratio", "bytes")
+    for _, policy := range strings.Split(*policies, ",") {
+        conf := config.CacheConfig{
+            Size: *size,
+            Policy: strings.TrimSpace(policy),
+            MaxBytes: *maxBytes,
+            MaxEntryBytes: *maxEntryBytes,
+        }
+        res, err := services.ReplayTrace(conf, trace)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+            return 1
+        }
+        fmt.Printf(
+            "%-6s %10d %10d %10d %10d %8.4f %12d\n",
+            res.Policy,
+            res.Accesses,
+            res.Hits,
+            res.Misses,
+            res.Evictions,
+            res.HitRatio(),
+            res.Bytes,
+        )
+    }
+    return 0
+}
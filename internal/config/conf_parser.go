@@ -18,10 +18,19 @@ type AppConfig struct {
     StoragePoolSize int `yaml:"storage_pool_size"`
     TSUpdateInterval time.Duration `yaml:"timestamp_interval"`
     RestoreRecordsLimit int `yaml:"restore_rec_limit"`
+    // reject / version
+    DedupPolicy string `yaml:"dedup_policy" env-default:"reject"`
+    // stan / jetstream
+    Broker string `yaml:"broker" env-default:"stan"`
+    // unique per running instance, hostname if empty
+    InstanceId string `yaml:"instance_id" env:"N_APP_INSTANCE_ID"`
     HTTPConf HTTPConfig `yaml:"http_server"`
     DBConf DBEngineConf `yaml:"dbengine"`
     StanConf StanConfig `yaml:"stan_server"`
+    JetStreamConf JetStreamConfig `yaml:"jetstream"`
     CacheConf CacheConfig `yaml:"memcache"`
+    L2Conf L2Config `yaml:"l2cache"`
+    SupervisorConf SupervisorConfig `yaml:"supervisor"`
 }
 
 // http-server config
@@ -31,6 +40,18 @@ type HTTPConfig struct {
     ResponseTimeout time.Duration `yaml:"resp_timeout"`
     KeepAlive bool `yaml:"keep_alive"`
     AliveTime time.Duration `yaml:"alive_time"`
+    // max order_uids in one batchGet request
+    BatchGetLimit int `yaml:"batch_get_limit" env-default:"500"`
+    // exports running at once, each holds db connection
+    MaxExports int `yaml:"max_exports" env-default:"2"`
+    // live feed: events buffered per client, slower client is disconnected
+    FeedBuffer int `yaml:"feed_buffer" env-default:"64"`
+    // 0 - no limit
+    FeedMaxClients int `yaml:"feed_max_clients" env-default:"100"`
+    // keeps idle connection open through proxies
+    FeedHeartbeat time.Duration `yaml:"feed_heartbeat" env-default:"15s"`
+    // max time for ordered draining on shutdown
+    ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env-default:"15s"`
 }
 
 // db config
@@ -53,11 +74,75 @@ type StanConfig struct {
     DurableName string `yaml:"durable_name"`
     Cluster_id string `yaml:"cluster_id"`
     Client_id string `yaml:"client_id"`
+    // instances in same group share messages,
+    // client_id gets instance_id suffix
+    QueueGroup string `yaml:"queue_group"`
+    Url string `yaml:"url" env-default:"nats://127.0.0.1:4222"`
+    // connection is lost after ping_max_out unanswered pings
+    PingInterval time.Duration `yaml:"ping_interval" env-default:"5s"`
+    PingMaxOut int `yaml:"ping_max_out" env-default:"3"`
+    ReconnectBackoff time.Duration `yaml:"reconnect_backoff" env-default:"1s"`
+    ReconnectMaxBackoff time.Duration `yaml:"reconnect_max_backoff" env-default:"30s"`
+}
+
+// JetStream durable pull consumer
+type JetStreamConfig struct {
+    Url string `yaml:"url" env-default:"nats://127.0.0.1:4222"`
+    Stream string `yaml:"stream"`
+    Subject string `yaml:"subject"`
+    DurableName string `yaml:"durable_name"`
+    AckWait time.Duration `yaml:"ack_wait" env-default:"30s"`
+    FetchBatch int `yaml:"fetch_batch" env-default:"32"`
+    FetchTimeout time.Duration `yaml:"fetch_timeout" env-default:"5s"`
+    FetchBackoff time.Duration `yaml:"fetch_backoff" env-default:"1s"`
+    FetchMaxBackoff time.Duration `yaml:"fetch_max_backoff" env-default:"30s"`
+    FetchMaxFailures int `yaml:"fetch_max_failures" env-default:"10"`
+}
+
+// retries before on_panic policy is applied
+type SupervisorConfig struct {
+    MaxRetries int `yaml:"max_retries" env-default:"5"`
+    Backoff time.Duration `yaml:"backoff" env-default:"1s"`
+    MaxBackoff time.Duration `yaml:"max_backoff" env-default:"30s"`
 }
 
 type CacheConfig struct {
     Size int `yaml:"size"`
     Exp_time time.Duration `yaml:"expiration_time"`
+    // eviction policy: lru / lfu / arc
+    Policy string `yaml:"policy" env-default:"lru"`
+    // total payload bytes, 0 - bounded by size only
+    MaxBytes int64 `yaml:"max_bytes"`
+    // larger payloads are not cached, 0 - no limit
+    MaxEntryBytes int64 `yaml:"max_entry_bytes"`
+    // max wait for db load on miss, 0 - no limit
+    LoadWait time.Duration `yaml:"load_wait" env-default:"3s"`
+    // not found orders are remembered, 0 - disabled
+    NegativeTTL time.Duration `yaml:"negative_ttl" env-default:"5s"`
+    NegativeSize int `yaml:"negative_size" env-default:"4096"`
+    // pending cache log keys, 0 - no limit
+    LogLimit int `yaml:"log_limit" env-default:"2048"`
+    // block / drop_oldest / flush
+    LogOverflow string `yaml:"log_overflow" env-default:"flush"`
+    // local snapshot for warm restarts, empty - disabled
+    SnapshotPath string `yaml:"snapshot_path"`
+    SnapshotInterval time.Duration `yaml:"snapshot_interval" env-default:"1m"`
+    // older snapshot is ignored, 0 - any age
+    SnapshotMaxAge time.Duration `yaml:"snapshot_max_age" env-default:"1h"`
+}
+
+// redis protocol second tier cache, empty addr - disabled
+type L2Config struct {
+    Addr string `yaml:"addr"`
+    Password string `yaml:"password" env:"N_APP_L2_PASSWORD"`
+    DB int `yaml:"db"`
+    KeyPrefix string `yaml:"key_prefix" env-default:"nats_app:order:"`
+    TTL time.Duration `yaml:"ttl" env-default:"10m"`
+    // per request, keep it small: db is the fallback
+    Timeout time.Duration `yaml:"timeout" env-default:"100ms"`
+    // failures in a row to open circuit
+    FailureThreshold int `yaml:"failure_threshold" env-default:"5"`
+    OpenTime time.Duration `yaml:"open_time" env-default:"30s"`
 }
 
 // build config struct
@@ -75,5 +160,12 @@ func MustBuildConfig(envKey string) *AppConfig {
         msg := fmt.Sprintf("Unreadable: %s", conf_path)
         log.Fatal(msg)
     }
+    if cfg.InstanceId == "" {
+        host, err := os.Hostname()
+        if err != nil {
+            log.Fatal(fmt.Sprintf("Empty instance_id: %s", err.Error()))
+        }
+        cfg.InstanceId = host
+    }
     return &cfg
 }
@@ -0,0 +1,109 @@
+package api
+
+import (
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "net/http"
+
+    "github.com/go-chi/render"
+
+    "nats_app/internal/services"
+)
+
+type BatchGetRequest struct {
+    OrderIds []string `json:"order_uids"`
+}
+
+type BatchGetItem struct {
+    OrderId string `json:"order_uid"`
+    Found bool `json:"found"`
+    // stored payload as is
+    Order json.RawMessage `json:"order,omitempty"`
+}
+
+type BatchGetResp struct {
+    RespReport
+    Items []BatchGetItem `json:"items"`
+    Found int `json:"found"`
+    Missing int `json:"missing"`
+}
+
+// POST /api/v1/orders:batchGet
+// hits are served from cache, misses are loaded
+// from db by one query and put into cache
+func BatchGetOrders(ca *services.AppCache, s services.AppStorage, limit int) http.HandlerFunc {
+    return func(wr http.ResponseWriter, req *http.Request) {
+        const loc = "api.handlers.BatchGetOrders"
+        logger := requestLogger(req, loc)
+        var request BatchGetRequest
+        if err := render.DecodeJSON(req.Body, &request); err != nil {
+            logger.Error("Request decoding failed", slog.Any("error", err))
+            render.Status(req, http.StatusBadRequest)
+            render.JSON(wr, req, ErrReport("can`t decode request"))
+            return
+        }
+        // keep request order, drop duplicates
+        seen := make(map[string]struct{}, len(request.OrderIds))
+        oids := make([]string, 0, len(request.OrderIds))
+        for _, oid := range request.OrderIds {
+            if oid == "" {
+                render.Status(req, http.StatusBadRequest)
+                render.JSON(wr, req, ErrReport("empty order_uid"))
+                return
+            }
+            if _, ok := seen[oid]; ok {
+                continue
+            }
+            seen[oid] = struct{}{}
+            oids = append(oids, oid)
+        }
+        if len(oids) == 0 || len(oids) > limit {
+            render.Status(req, http.StatusBadRequest)
+            render.JSON(wr, req, ErrReport(fmt.Sprintf("expected from 1 to %d order_uids", limit)))
+            return
+        }
+
+        found, missing, _ := ca.GetMany(oids)
+        if len(missing) > 0 {
+            loaded, err := s.FetchOrders(missing)
+            if err != nil {
+                logger.Error("Batch lookup failed", slog.Any("error", err))
+                status, msg := lookupErrStatus(err)
+                render.Status(req, status)
+                render.JSON(wr, req, ErrReport(msg))
+                return
+            }
+            var notFound []string
+            for _, ord := range loaded {
+                found[ord.Oid] = ord
+            }
+            for _, oid := range missing {
+                if _, ok := found[oid]; !ok {
+                    notFound = append(notFound, oid)
+                }
+            }
+            if err = ca.Backfill(loaded, notFound); err != nil {
+                logger.Warn("Cache backfill failed", slog.Any("error", err))
+            }
+        }
+
+        resp := BatchGetResp{
+            RespReport: RespReport{Status: StatusOk},
+            Items: make([]BatchGetItem, 0, len(oids)),
+        }
+        for _, oid := range oids {
+            item := BatchGetItem{OrderId: oid}
+            if ord, ok := found[oid]; ok && ord.Payload != nil {
+                item.Found = true
+                item.Order = json.RawMessage(*ord.Payload)
+                resp.Found++
+            } else {
+                resp.Missing++
+            }
+            resp.Items = append(resp.Items, item)
+        }
+        render.JSON(wr, req, resp)
+        return
+    }
+}
@@ -0,0 +1,20 @@
+package api
+
+import (
+    "net/http"
+
+    "github.com/go-chi/render"
+
+    "nats_app/internal/services"
+)
+
+// GET /api/v1/cache/stats - payload bytes, entries and largest items
+func GetCacheStats(ca *services.AppCache) http.HandlerFunc {
+    return func(wr http.ResponseWriter, req *http.Request) {
+        render.JSON(wr, req, CacheStatsResp{
+            RespReport: RespReport{Status: StatusOk},
+            Cache: ca.Stats(),
+        })
+        return
+    }
+}
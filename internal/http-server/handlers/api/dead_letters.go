@@ -0,0 +1,148 @@
+package api
+
+import (
+    "net/http"
+    "log/slog"
+    "io"
+    "strconv"
+
+    "github.com/go-chi/chi/v5"
+    "github.com/go-chi/render"
+
+    "nats_app/internal/services"
+)
+
+const (
+    DeadLetterIdParam string = "id"
+    // max size of fixed message on resubmit
+    MaxResubmitBody int64 = 1 << 20
+)
+
+func toDeadLetterItem(dl services.DeadLetter, withRaw bool) DeadLetterItem {
+    item := DeadLetterItem{
+        Id: dl.Id,
+        Subject: dl.Subject,
+        Sequence: dl.Sequence,
+        Timestamp: dl.Timestamp,
+        Error: dl.Error,
+        CreatedAt: dl.CreatedAt,
+        ResubmittedAt: dl.ResubmittedAt,
+    }
+    if withRaw {
+        item.Raw = string(dl.Raw)
+    }
+    return item
+}
+
+func parseDeadLetterId(req *http.Request) (int64, bool) {
+    id, err := strconv.ParseInt(chi.URLParam(req, DeadLetterIdParam), 10, 64)
+    return id, err == nil && id > 0
+}
+
+// GET /dead-letters?limit=&cursor=
+func ListDeadLetters(s services.AppStorage) http.HandlerFunc {
+    return func(wr http.ResponseWriter, req *http.Request) {
+        const loc = "api.handlers.ListDeadLetters"
+        var err error
+        var after int64
+        logger := requestLogger(req, loc)
+        limit := services.DefaultPageLimit
+        q := req.URL.Query()
+        if v := q.Get("limit"); v != "" {
+            if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > services.MaxPageLimit {
+                render.Status(req, http.StatusBadRequest)
+                render.JSON(wr, req, ErrReport("invalid limit"))
+                return
+            }
+        }
+        if v := q.Get("cursor"); v != "" {
+            if after, err = decodeCursor(v); err != nil {
+                render.Status(req, http.StatusBadRequest)
+                render.JSON(wr, req, ErrReport("invalid cursor"))
+                return
+            }
+        }
+        // fetch one extra row to know if next page exists
+        letters, err := s.ListDeadLetters(after, limit + 1)
+        if err != nil {
+            logger.Error("Dead letters listing failed", slog.Any("error", err))
+            status, msg := lookupErrStatus(err)
+            render.Status(req, status)
+            render.JSON(wr, req, ErrReport(msg))
+            return
+        }
+        resp := DeadLettersPage{
+            RespReport: RespReport{Status: StatusOk},
+            Items: make([]DeadLetterItem, 0, len(letters)),
+        }
+        for i, dl := range letters {
+            if i == limit {
+                resp.NextCursor = encodeCursor(letters[i - 1].Id)
+                break
+            }
+            resp.Items = append(resp.Items, toDeadLetterItem(dl, false))
+        }
+        resp.Count = len(resp.Items)
+        render.JSON(wr, req, resp)
+        return
+    }
+}
+
+// GET /dead-letters/{id}
+func GetDeadLetter(s services.AppStorage) http.HandlerFunc {
+    return func(wr http.ResponseWriter, req *http.Request) {
+        const loc = "api.handlers.GetDeadLetter"
+        logger := requestLogger(req, loc)
+        id, ok := parseDeadLetterId(req)
+        if !ok {
+            render.Status(req, http.StatusBadRequest)
+            render.JSON(wr, req, ErrReport("invalid id"))
+            return
+        }
+        dl, err := s.FetchDeadLetter(id)
+        if err != nil {
+            logger.Info("Dead letter lookup failed", slog.Int64("id", id), slog.Any("error", err))
+            status, msg := lookupErrStatus(err)
+            render.Status(req, status)
+            render.JSON(wr, req, ErrReport(msg))
+            return
+        }
+        render.JSON(wr, req, DeadLetterResp{
+            RespReport: RespReport{Status: StatusOk},
+            DeadLetter: toDeadLetterItem(dl, true),
+        })
+        return
+    }
+}
+
+// POST /dead-letters/{id}/resubmit
+// body - fixed message, empty body resubmits stored one
+func ResubmitDeadLetter(s services.AppStorage) http.HandlerFunc {
+    return func(wr http.ResponseWriter, req *http.Request) {
+        const loc = "api.handlers.ResubmitDeadLetter"
+        logger := requestLogger(req, loc)
+        id, ok := parseDeadLetterId(req)
+        if !ok {
+            render.Status(req, http.StatusBadRequest)
+            render.JSON(wr, req, ErrReport("invalid id"))
+            return
+        }
+        data, err := io.ReadAll(http.MaxBytesReader(wr, req.Body, MaxResubmitBody))
+        if err != nil {
+            render.Status(req, http.StatusRequestEntityTooLarge)
+            render.JSON(wr, req, ErrReport("can`t read message"))
+            return
+        }
+        if err = s.Resubmit(id, data); err != nil {
+            logger.Info("Resubmit failed", slog.Int64("id", id), slog.Any("error", err))
+            status, msg := lookupErrStatus(err)
+            render.Status(req, status)
+            render.JSON(wr, req, ErrReport(msg))
+            return
+        }
+        logger.Info("Dead letter resubmitted", slog.Int64("id", id))
+        render.Status(req, http.StatusAccepted)
+        render.JSON(wr, req, RespReport{Status: StatusOk})
+        return
+    }
+}
@@ -0,0 +1,194 @@
+package api
+
+import (
+    "bytes"
+    "encoding/csv"
+    "encoding/json"
+    "errors"
+    "log/slog"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/go-chi/render"
+
+    "nats_app/internal/services"
+    "nats_app/internal/storage"
+)
+
+const (
+    ExportNDJSON string = "ndjson"
+    ExportCSV string = "csv"
+    // rows between flushes to client
+    exportFlushEvery int = 100
+)
+
+var csvHeader = []string{
+    "order_uid", "track_number", "entry", "locale", "internal_signature",
+    "customer_id", "delivery_service", "shardkey", "sm_id", "date_created", "oof_shard",
+    "delivery_name", "delivery_phone", "delivery_zip", "delivery_city",
+    "delivery_address", "delivery_region", "delivery_email",
+    "payment_transaction", "payment_request_id", "payment_currency", "payment_provider",
+    "payment_amount", "payment_dt", "payment_bank", "payment_delivery_cost",
+    "payment_goods_total", "payment_customs_fee",
+    "item_chrt_id", "item_track_number", "item_price", "item_rid", "item_name",
+    "item_sale", "item_size", "item_total_price", "item_nm_id", "item_brand", "item_status",
+}
+
+// one csv row per item, order without items gives one row
+func orderCSVRows(o *storage.CustomerOrder) [][]string {
+    itoa := strconv.Itoa
+    head := []string{
+        o.Order_id, o.Track_numb, o.Entry, o.Locale, o.IntSing,
+        o.CustomerId, o.DeliveryServ, o.Shardkey, itoa(o.SmId),
+        o.DateCreated.Format(time.RFC3339), o.OofShard,
+        o.Delivery.Name, o.Delivery.Phone, o.Delivery.Zip, o.Delivery.City,
+        o.Delivery.Address, o.Delivery.Region, o.Delivery.Email,
+        o.Payment.Trans, o.Payment.ReqId, o.Payment.Currency, o.Payment.Provider,
+        itoa(o.Payment.Amount), strconv.FormatInt(o.Payment.PaymentDt, 10), o.Payment.Bank,
+        itoa(o.Payment.DelivCost), itoa(o.Payment.GoodsTotal), itoa(o.Payment.CustomsFee),
+    }
+    if len(o.Items) == 0 {
+        return [][]string{append(head, make([]string, len(csvHeader) - len(head))...)}
+    }
+    rows := make([][]string, 0, len(o.Items))
+    for _, it := range o.Items {
+        row := make([]string, 0, len(csvHeader))
+        row = append(row, head...)
+        row = append(row,
+            itoa(it.ChrtId), it.TrNumber, itoa(it.Price), it.Rid, it.Name,
+            itoa(it.Sale), it.Size, itoa(it.TotalPrice), itoa(it.NmId), it.Brand, itoa(it.Status),
+        )
+        rows = append(rows, row)
+    }
+    return rows
+}
+
+func parseExportFilter(req *http.Request) (services.ExportFilter, error) {
+    var f services.ExportFilter
+    var err error
+    q := req.URL.Query()
+    if v := q.Get("from"); v != "" {
+        if f.From, err = time.Parse(time.RFC3339, v); err != nil {
+            return f, errors.New("from must be RFC3339")
+        }
+    }
+    if v := q.Get("to"); v != "" {
+        if f.To, err = time.Parse(time.RFC3339, v); err != nil {
+            return f, errors.New("to must be RFC3339")
+        }
+    }
+    if !f.From.IsZero() && !f.To.IsZero() && !f.From.Before(f.To) {
+        return f, errors.New("from must be before to")
+    }
+    return f, nil
+}
+
+// GET /api/v1/orders/export?format=ndjson|csv&from=&to=
+// rows are streamed from db cursor, nothing is buffered.
+// Error after first row can`t change status, stream is cut.
+func ExportOrders(s services.AppStorage) http.HandlerFunc {
+    return func(wr http.ResponseWriter, req *http.Request) {
+        const loc = "api.handlers.ExportOrders"
+        logger := requestLogger(req, loc)
+        format := req.URL.Query().Get("format")
+        if format == "" {
+            format = ExportNDJSON
+        }
+        if format != ExportNDJSON && format != ExportCSV {
+            render.Status(req, http.StatusBadRequest)
+            render.JSON(wr, req, ErrReport("format must be ndjson or csv"))
+            return
+        }
+        f, err := parseExportFilter(req)
+        if err != nil {
+            render.Status(req, http.StatusBadRequest)
+            render.JSON(wr, req, ErrReport(err.Error()))
+            return
+        }
+
+        // server write timeout is for regular responses,
+        // export lasts as long as client reads it
+        if err := http.NewResponseController(wr).SetWriteDeadline(time.Time{}); err != nil {
+            logger.Debug("Write deadline is kept", slog.Any("error", err))
+        }
+        flusher, _ := wr.(http.Flusher)
+        var rows int
+        var cw *csv.Writer
+        var compact bytes.Buffer
+        started := false
+        start := func() {
+            started = true
+            if format == ExportCSV {
+                wr.Header().Set("Content-Type", "text/csv; charset=utf-8")
+                wr.Header().Set("Content-Disposition", `attachment; filename="orders.csv"`)
+                cw = csv.NewWriter(wr)
+                cw.Write(csvHeader)
+            } else {
+                wr.Header().Set("Content-Type", "application/x-ndjson")
+            }
+            wr.WriteHeader(http.StatusOK)
+        }
+        flush := func() {
+            if cw != nil {
+                cw.Flush()
+            }
+            if flusher != nil {
+                flusher.Flush()
+            }
+        }
+        err = s.ExportOrders(req.Context(), f, func(raw []byte) error {
+            if !started {
+                start()
+            }
+            if format == ExportCSV {
+                var order storage.CustomerOrder
+                if err := json.Unmarshal(raw, &order); err != nil {
+                    return err
+                }
+                for _, row := range orderCSVRows(&order) {
+                    if err := cw.Write(row); err != nil {
+                        return err
+                    }
+                }
+            } else {
+                // one line per order
+                compact.Reset()
+                if err := json.Compact(&compact, raw); err != nil {
+                    return err
+                }
+                compact.WriteByte('\n')
+                if _, err := wr.Write(compact.Bytes()); err != nil {
+                    return err
+                }
+            }
+            rows++
+            if rows % exportFlushEvery == 0 {
+                flush()
+            }
+            return nil
+        })
+        if err != nil && !started {
+            logger.Error("Export failed", slog.Any("error", err))
+            status, msg := lookupErrStatus(err)
+            if errors.Is(err, services.ExportBusy) {
+                status, msg = http.StatusTooManyRequests, "too many exports in progress"
+            }
+            render.Status(req, status)
+            render.JSON(wr, req, ErrReport(msg))
+            return
+        }
+        if err != nil {
+            logger.Error("Export interrupted", slog.Int("orders", rows), slog.Any("error", err))
+            flush()
+            return
+        }
+        if !started {
+            // empty range, still valid document
+            start()
+        }
+        flush()
+        logger.Info("Export finished", slog.Int("orders", rows))
+        return
+    }
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+    "testing"
+    "time"
+
+    "nats_app/internal/storage"
+)
+
+func TestOrderCSVRows(t *testing.T) {
+    order := storage.CustomerOrder{
+        Order_id: "o1",
+        CustomerId: "c1",
+        SmId: 99,
+        DateCreated: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+    }
+    order.Delivery.City = "Kiryat Mozkin"
+    order.Payment.Amount = 1817
+    items := []storage.OrderItem{
+        {ChrtId: 1, Name: "Mascaras", Status: 202},
+        {ChrtId: 2, Name: "Lipstick", Price: 10},
+    }
+    column := func(name string) int {
+        for i, h := range csvHeader {
+            if h == name {
+                return i
+            }
+        }
+        t.Fatalf("no column %s", name)
+        return -1
+    }
+    cases := []struct {
+        name string
+        items []storage.OrderItem
+        // item_name per row
+        want []string
+    }{
+        {"no items", nil, []string{""}},
+        {"one item", items[:1], []string{"Mascaras"}},
+        {"row per item", items, []string{"Mascaras", "Lipstick"}},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            order.Items = tc.items
+            rows := orderCSVRows(&order)
+            if len(rows) != len(tc.want) {
+                t.Fatalf("%d rows, want %d", len(rows), len(tc.want))
+            }
+            for i, row := range rows {
+                if len(row) != len(csvHeader) {
+                    t.Fatalf("row %d: %d columns, header %d", i, len(row), len(csvHeader))
+                }
+                if row[column("item_name")] != tc.want[i] {
+                    t.Fatalf("row %d: item_name %q, want %q", i, row[column("item_name")], tc.want[i])
+                }
+                // order fields are repeated in every row
+                checks := map[string]string{
+                    "order_uid": "o1",
+                    "customer_id": "c1",
+                    "sm_id": "99",
+                    "date_created": "2024-01-02T03:04:05Z",
+                    "delivery_city": "Kiryat Mozkin",
+                    "payment_amount": "1817",
+                }
+                for name, want := range checks {
+                    if got := row[column(name)]; got != want {
+                        t.Fatalf("row %d: %s %q, want %q", i, name, got, want)
+                    }
+                }
+            }
+        })
+    }
+}
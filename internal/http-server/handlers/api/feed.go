@@ -0,0 +1,106 @@
+package api
+
+import (
+    "errors"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "time"
+
+    "github.com/go-chi/render"
+
+    "nats_app/internal/services"
+)
+
+// client that can`t take one event in time is dropped,
+// socket buffers would hide slow consumer otherwise
+const feedWriteWait = 10 * time.Second
+
+// GET /api/v1/orders/feed?delivery_service=&customer_id=
+// Server-Sent Events, one "order" event per saved order.
+// Client is disconnected if it doesn`t keep up with feed,
+// last "close" event tells the reason.
+// Delivery is at most once: events have no id, missed ones
+// are not replayed on reconnect, use orders list to catch up.
+func OrderFeed(feed *services.OrderFeed, heartbeat time.Duration) http.HandlerFunc {
+    return func(wr http.ResponseWriter, req *http.Request) {
+        const loc = "api.handlers.OrderFeed"
+        logger := requestLogger(req, loc)
+        q := req.URL.Query()
+        filter := services.FeedFilter{
+            DeliveryServ: q.Get("delivery_service"),
+            CustomerId: q.Get("customer_id"),
+        }
+        sub, err := feed.Subscribe(filter)
+        if err != nil {
+            status, msg := http.StatusServiceUnavailable, "feed is closed"
+            if errors.Is(err, services.FeedFull) {
+                status, msg = http.StatusTooManyRequests, "too many feed subscribers"
+            }
+            render.Status(req, status)
+            render.JSON(wr, req, ErrReport(msg))
+            return
+        }
+        defer feed.Unsubscribe(sub)
+        // connection lives until client or feed closes it,
+        // each event has own write deadline
+        rc := http.NewResponseController(wr)
+        send := func(format string, args ...any) error {
+            if err := rc.SetWriteDeadline(time.Now().Add(feedWriteWait)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+                return err
+            }
+            if _, err := fmt.Fprintf(wr, format, args...); err != nil {
+                return err
+            }
+            return rc.Flush()
+        }
+
+        wr.Header().Set("Content-Type", "text/event-stream")
+        wr.Header().Set("Cache-Control", "no-cache")
+        wr.Header().Set("Connection", "keep-alive")
+        // nginx must not buffer events
+        wr.Header().Set("X-Accel-Buffering", "no")
+        wr.WriteHeader(http.StatusOK)
+        // client retries after 3s on network errors
+        if err := send("retry: 3000\n\n"); err != nil {
+            logger.Error("Feed stream failed", slog.Any("error", err))
+            return
+        }
+        logger.Info("Feed subscriber connected",
+            slog.String("delivery_service", filter.DeliveryServ),
+            slog.String("customer_id", filter.CustomerId),
+        )
+
+        var ping <-chan time.Time
+        if heartbeat > 0 {
+            ticker := time.NewTicker(heartbeat)
+            defer ticker.Stop()
+            ping = ticker.C
+        }
+        var sent int
+        for {
+            select {
+            case <-req.Context().Done():
+                logger.Info("Feed subscriber gone", slog.Int("events", sent))
+                return
+            case <-sub.Done():
+                reason := sub.Err()
+                logger.Warn("Feed subscriber dropped", slog.Int("events", sent), slog.Any("reason", reason))
+                send("event: close\ndata: %s\n\n", reason.Error())
+                return
+            case ev := <-sub.Events():
+                if err := send("event: order\ndata: %s\n\n", ev.Payload); err != nil {
+                    logger.Warn("Feed write failed", slog.Int("events", sent), slog.Any("error", err))
+                    return
+                }
+                sent++
+            case <-ping:
+                // comment line, ignored by EventSource
+                if err := send(": ping\n\n"); err != nil {
+                    logger.Warn("Feed write failed", slog.Int("events", sent), slog.Any("error", err))
+                    return
+                }
+            }
+        }
+    }
+}
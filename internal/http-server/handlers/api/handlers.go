@@ -4,8 +4,16 @@ import (
     "net/http"
     "log/slog"
     "encoding/json"
+    "errors"
+    "crypto/sha256"
+    "encoding/base64"
+    "fmt"
     "os"
+    "strings"
+    "strconv"
+    "time"
 
+    "github.com/go-chi/chi/v5"
     "github.com/go-chi/render"
     "github.com/go-chi/chi/v5/middleware"
     "github.com/go-playground/validator/v10"
@@ -14,6 +22,10 @@ import (
     "nats_app/internal/storage"
 )
 
+const (
+    OrderUidParam string = "order_uid"
+)
+
 // we send only OrderId
 type Request struct {
     OrderId string `json:"order_uid"`
@@ -25,6 +37,60 @@ type Response struct {
     CustomerOrder storage.CustomerOrder
 }
 
+// setup call location & request_id for search
+func requestLogger(req *http.Request, loc string) *slog.Logger {
+    logger := slog.New(
+        slog.NewTextHandler(
+            os.Stdout,
+            &slog.HandlerOptions{Level: slog.LevelDebug},
+        ),
+    )
+    return logger.With(
+        slog.String("loc", loc),
+        slog.String("request_id", middleware.GetReqID(req.Context())),
+    )
+}
+
+// strong ETag, derived from exact payload bytes. Cache, L2,
+// snapshot and orders.raw_payload hold the same bytes as received,
+// so ETag doesn`t change after eviction, restart or on other instance.
+func payloadETag(payload []byte) string {
+    return fmt.Sprintf("\"%x\"", sha256.Sum256(payload))
+}
+
+// check If-None-Match header value against current ETag
+func etagMatch(header string, etag string) bool {
+    if header == "" {
+        return false
+    }
+    for _, tag := range strings.Split(header, ",") {
+        tag = strings.TrimSpace(tag)
+        if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+            return true
+        }
+    }
+    return false
+}
+
+// map order lookup error to http status and message
+func lookupErrStatus(err error) (int, string) {
+    var DBTimeout *services.DBTimeout
+    var DBCritical *services.DBConnectionLost
+    switch {
+    case errors.Is(err, services.OrderNotFound):
+        return http.StatusNotFound, "order not found"
+    case errors.Is(err, services.DeadLetterNotFound):
+        return http.StatusNotFound, "dead letter not found"
+    case errors.Is(err, services.InvalidOrder):
+        return http.StatusUnprocessableEntity, err.Error()
+    case errors.As(err, &DBTimeout), errors.Is(err, services.CacheLoadTimeout):
+        return http.StatusGatewayTimeout, "storage timeout"
+    case errors.As(err, &DBCritical):
+        return http.StatusServiceUnavailable, "storage unavailable"
+    }
+    return http.StatusInternalServerError, "internal error"
+}
+
 // get order by id
 func GetOrder(
     v *validator.Validate,
@@ -35,37 +101,29 @@ func GetOrder(
         // const for idenfication
         const loc = "api.handlers"
         var cOrder storage.CustomerOrder
-        // setup call location & request_id for search
-        logger := slog.New(
-            slog.NewTextHandler(
-                os.Stdout,
-                &slog.HandlerOptions{Level: slog.LevelDebug},
-            ),
-        )
-        logger = logger.With(
-            slog.String("loc", loc),
-            slog.String("request_id", middleware.GetReqID(req.Context())),
-        )
+        logger := requestLogger(req, loc)
         var request Request
         // parse requsest and set model
         err := render.DecodeJSON(req.Body, &request)
         if err != nil {
-            logger.Error("Request decoding failed", err)
+            logger.Error("Request decoding failed", slog.Any("error", err))
             render.JSON(wr, req, "can`t decode request")
             return
         }
         // in slog.any info about decoded request
         logger.Info("Request decoded", slog.Any("request", request))
         if val_err := v.Struct(request); val_err != nil {
-            logger.Error("Invalid request", val_err)
+            logger.Error("Invalid request", slog.Any("error", val_err))
             render.JSON(wr, req, "can`t parse request")
             return
         }
         // try fetch data from cache
         order, err := (*ca).Get(request.OrderId)
         if err != nil {
-            logger.Error("No same order", err)
-            render.JSON(wr, req, "No same order")
+            logger.Error("No same order", slog.Any("error", err))
+            status, msg := lookupErrStatus(err)
+            render.Status(req, status)
+            render.JSON(wr, req, ErrReport(msg))
             return
         }
         json.Unmarshal(*order.Payload, &cOrder)
@@ -76,3 +134,136 @@ func GetOrder(
         return
     }
 }
+
+// GET /orders/{order_uid}
+// supports conditional requests with If-None-Match
+func GetOrderByUid(ca *services.AppCache) http.HandlerFunc {
+    return func(wr http.ResponseWriter, req *http.Request) {
+        const loc = "api.handlers.GetOrderByUid"
+        var cOrder storage.CustomerOrder
+        logger := requestLogger(req, loc)
+        oid := chi.URLParam(req, OrderUidParam)
+        if oid == "" {
+            render.Status(req, http.StatusBadRequest)
+            render.JSON(wr, req, ErrReport("empty order_uid"))
+            return
+        }
+        order, err := (*ca).Get(oid)
+        if err != nil {
+            logger.Info("Order lookup failed", slog.String("order_uid", oid), slog.Any("error", err))
+            status, msg := lookupErrStatus(err)
+            render.Status(req, status)
+            render.JSON(wr, req, ErrReport(msg))
+            return
+        }
+        etag := payloadETag(*order.Payload)
+        wr.Header().Set("ETag", etag)
+        wr.Header().Set("Cache-Control", "no-cache")
+        if etagMatch(req.Header.Get("If-None-Match"), etag) {
+            wr.WriteHeader(http.StatusNotModified)
+            return
+        }
+        if err = json.Unmarshal(*order.Payload, &cOrder); err != nil {
+            logger.Error("Stored order is invalid", slog.Any("error", err))
+            render.Status(req, http.StatusInternalServerError)
+            render.JSON(wr, req, ErrReport("can`t decode stored order"))
+            return
+        }
+        render.JSON(wr, req, Response{
+            RespReport: RespReport{Status: StatusOk},
+            CustomerOrder: cOrder,
+        })
+        return
+    }
+}
+
+func encodeCursor(seq int64) string {
+    return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(seq, 10)))
+}
+
+func decodeCursor(cursor string) (int64, error) {
+    raw, err := base64.RawURLEncoding.DecodeString(cursor)
+    if err != nil {
+        return 0, err
+    }
+    seq, err := strconv.ParseInt(string(raw), 10, 64)
+    if err != nil || seq <= 0 {
+        return 0, errors.New("invalid cursor")
+    }
+    return seq, nil
+}
+
+// build search filter from query params
+func parseOrderFilter(req *http.Request) (services.OrderFilter, error) {
+    var err error
+    q := req.URL.Query()
+    f := services.OrderFilter{
+        CustomerId:         q.Get("customer_id"),
+        TrackNumber:        q.Get("track_number"),
+        DeliveryService:    q.Get("delivery_service"),
+        Locale:             q.Get("locale"),
+        Transaction:        q.Get("transaction"),
+    }
+    if v := q.Get("created_from"); v != "" {
+        if f.CreatedFrom, err = time.Parse(time.RFC3339, v); err != nil {
+            return f, errors.New("created_from must be RFC3339")
+        }
+    }
+    if v := q.Get("created_to"); v != "" {
+        if f.CreatedTo, err = time.Parse(time.RFC3339, v); err != nil {
+            return f, errors.New("created_to must be RFC3339")
+        }
+    }
+    if v := q.Get("limit"); v != "" {
+        if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit <= 0 {
+            return f, errors.New("limit must be positive integer")
+        }
+    }
+    if v := q.Get("cursor"); v != "" {
+        if f.After, err = decodeCursor(v); err != nil {
+            return f, errors.New("invalid cursor")
+        }
+    }
+    return f, nil
+}
+
+// GET /orders?customer_id=&track_number=&delivery_service=
+// &locale=&transaction=&created_from=&created_to=&limit=&cursor=
+func ListOrders(s services.AppStorage) http.HandlerFunc {
+    return func(wr http.ResponseWriter, req *http.Request) {
+        const loc = "api.handlers.ListOrders"
+        logger := requestLogger(req, loc)
+        filter, err := parseOrderFilter(req)
+        if err != nil {
+            render.Status(req, http.StatusBadRequest)
+            render.JSON(wr, req, ErrReport(err.Error()))
+            return
+        }
+        page, err := s.SearchOrders(filter)
+        if err != nil {
+            logger.Error("Orders search failed", slog.Any("error", err))
+            status, msg := lookupErrStatus(err)
+            render.Status(req, status)
+            render.JSON(wr, req, ErrReport(msg))
+            return
+        }
+        resp := OrdersPage{
+            RespReport: RespReport{Status: StatusOk},
+            Items: make([]storage.CustomerOrder, 0, len(page.Items)),
+        }
+        for _, order := range page.Items {
+            var cOrder storage.CustomerOrder
+            if err = json.Unmarshal(*order.Payload, &cOrder); err != nil {
+                logger.Error("Stored order is invalid", slog.String("order_uid", order.Oid), slog.Any("error", err))
+                continue
+            }
+            resp.Items = append(resp.Items, cOrder)
+        }
+        resp.Count = len(resp.Items)
+        if page.HasMore {
+            resp.NextCursor = encodeCursor(page.Last)
+        }
+        render.JSON(wr, req, resp)
+        return
+    }
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+    "encoding/base64"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+func TestCursor(t *testing.T) {
+    for _, seq := range []int64{1, 42, 1 << 40} {
+        got, err := decodeCursor(encodeCursor(seq))
+        if err != nil || got != seq {
+            t.Fatalf("round trip %d: %d, %v", seq, got, err)
+        }
+    }
+    raw := func(s string) string {
+        return base64.RawURLEncoding.EncodeToString([]byte(s))
+    }
+    for _, cursor := range []string{"", "not base64!", raw("abc"), raw("0"), raw("-5"), raw("1.5")} {
+        if seq, err := decodeCursor(cursor); err == nil {
+            t.Fatalf("cursor %q accepted: %d", cursor, seq)
+        }
+    }
+}
+
+func TestParseOrderFilter(t *testing.T) {
+    cases := []struct {
+        name string
+        query string
+        check func(t *testing.T, after int64, limit int, from time.Time)
+        fail bool
+    }{
+        {
+            name: "empty",
+            check: func(t *testing.T, after int64, limit int, from time.Time) {
+                if after != 0 || limit != 0 || !from.IsZero() {
+                    t.Fatalf("after %d, limit %d, from %v", after, limit, from)
+                }
+            },
+        },
+        {
+            name: "page",
+            query: "limit=10&cursor=" + encodeCursor(77) + "&created_from=2024-01-02T03:04:05Z",
+            check: func(t *testing.T, after int64, limit int, from time.Time) {
+                if after != 77 || limit != 10 || !from.Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)) {
+                    t.Fatalf("after %d, limit %d, from %v", after, limit, from)
+                }
+            },
+        },
+        {name: "zero limit", query: "limit=0", fail: true},
+        {name: "bad limit", query: "limit=ten", fail: true},
+        {name: "bad cursor", query: "cursor=abc", fail: true},
+        {name: "bad created_from", query: "created_from=2024-01-02", fail: true},
+        {name: "bad created_to", query: "created_to=yesterday", fail: true},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            req := httptest.NewRequest("GET", "/api/v1/orders?" + tc.query, nil)
+            f, err := parseOrderFilter(req)
+            if tc.fail {
+                if err == nil {
+                    t.Fatalf("accepted: %+v", f)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            tc.check(t, f.After, f.Limit, f.CreatedFrom)
+        })
+    }
+}
+
+func TestPayloadETag(t *testing.T) {
+    payload := []byte(`{"order_uid": "o1", "entry": "WBIL"}`)
+    etag := payloadETag(payload)
+    if etag != payloadETag(append([]byte(nil), payload...)) {
+        t.Fatal("same bytes give different etag")
+    }
+    // normalized json is other representation
+    if etag == payloadETag([]byte(`{"entry": "WBIL", "order_uid": "o1"}`)) {
+        t.Fatal("different bytes give same etag")
+    }
+    cases := []struct {
+        header string
+        want bool
+    }{
+        {"", false},
+        {etag, true},
+        {"W/" + etag, true},
+        {`"other", ` + etag, true},
+        {"*", true},
+        {`"other"`, false},
+    }
+    for _, tc := range cases {
+        if got := etagMatch(tc.header, etag); got != tc.want {
+            t.Fatalf("etagMatch(%q) = %v", tc.header, got)
+        }
+    }
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+    "net/http"
+
+    "github.com/go-chi/render"
+
+    "nats_app/internal/services"
+)
+
+func healthReport(ok bool, components map[string]services.ComponentStatus) HealthReport {
+    report := HealthReport{RespReport: RespReport{Status: StatusOk}, Components: components}
+    if !ok {
+        report.RespReport = ErrReport("some components are not ready")
+    }
+    return report
+}
+
+// GET /healthz - liveness, process is able to answer.
+// Components are reported, but never fail the probe.
+func Healthz(h *services.Health) http.HandlerFunc {
+    return func(wr http.ResponseWriter, req *http.Request) {
+        ok, components := h.Check()
+        report := healthReport(ok, components)
+        // process is alive anyway
+        report.Status = StatusOk
+        render.JSON(wr, req, report)
+        return
+    }
+}
+
+// GET /readyz - readiness, 503 if any component is not ready
+// (db unreachable, broker disconnected, cache restore running)
+func Readyz(h *services.Health) http.HandlerFunc {
+    return func(wr http.ResponseWriter, req *http.Request) {
+        ok, components := h.Check()
+        if !ok {
+            render.Status(req, http.StatusServiceUnavailable)
+        }
+        render.JSON(wr, req, healthReport(ok, components))
+        return
+    }
+}
@@ -1,6 +1,66 @@
 package api
 
+import (
+    "time"
+
+    "nats_app/internal/services"
+    "nats_app/internal/storage"
+)
+
+const (
+    StatusOk string = "ok"
+    StatusError string = "error"
+)
+
 type RespReport struct {
     Status string `json:"status"`
     Error string `json:"error,omitempty"`
 }
+
+// build error report for response body
+func ErrReport(msg string) RespReport {
+    return RespReport{Status: StatusError, Error: msg}
+}
+
+// stable envelope for orders listing
+type OrdersPage struct {
+    RespReport
+    Items []storage.CustomerOrder `json:"items"`
+    Count int `json:"count"`
+    // opaque, pass as <cursor> to get next page
+    NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type DeadLetterItem struct {
+    Id int64 `json:"id"`
+    Subject string `json:"subject"`
+    Sequence uint64 `json:"sequence"`
+    Timestamp time.Time `json:"timestamp"`
+    Error string `json:"error"`
+    CreatedAt time.Time `json:"created_at"`
+    ResubmittedAt *time.Time `json:"resubmitted_at,omitempty"`
+    // only in single item response
+    Raw string `json:"raw,omitempty"`
+}
+
+type DeadLettersPage struct {
+    RespReport
+    Items []DeadLetterItem `json:"items"`
+    Count int `json:"count"`
+    NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type DeadLetterResp struct {
+    RespReport
+    DeadLetter DeadLetterItem `json:"dead_letter"`
+}
+
+type HealthReport struct {
+    RespReport
+    Components map[string]services.ComponentStatus `json:"components"`
+}
+
+type CacheStatsResp struct {
+    RespReport
+    Cache services.CacheStats `json:"cache"`
+}
@@ -0,0 +1,25 @@
+package http_server
+
+import (
+    "net"
+    "net/http"
+
+    "nats_app/internal/config"
+)
+
+// build http.Server from config.
+// ResponseTimeout bounds reading a request and
+// writing a response, AliveTime - idle keep-alive connection.
+func New(conf *config.HTTPConfig, h http.Handler) *http.Server {
+    srv := &http.Server{
+        Addr:               net.JoinHostPort(conf.Host, conf.Port),
+        Handler:            h,
+        ReadHeaderTimeout:  conf.ResponseTimeout,
+        ReadTimeout:        conf.ResponseTimeout,
+        // handler timeout + time to flush response
+        WriteTimeout:       2 * conf.ResponseTimeout,
+        IdleTimeout:        conf.AliveTime,
+    }
+    srv.SetKeepAlivesEnabled(conf.KeepAlive)
+    return srv
+}
@@ -0,0 +1,177 @@
+package metrics
+
+import (
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/go-chi/chi/v5"
+    "github.com/go-chi/chi/v5/middleware"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promauto"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+    namespace string = "nats_app"
+)
+
+var (
+    // ingestion
+    MessagesReceived = promauto.NewCounter(prometheus.CounterOpts{
+        Namespace: namespace,
+        Name: "messages_received_total",
+        Help: "Messages received from broker.",
+    })
+    MessagesValidated = promauto.NewCounter(prometheus.CounterOpts{
+        Namespace: namespace,
+        Name: "messages_validated_total",
+        Help: "Messages decoded and validated.",
+    })
+    MessagesRejected = promauto.NewCounter(prometheus.CounterOpts{
+        Namespace: namespace,
+        Name: "messages_rejected_total",
+        Help: "Messages failed decoding or validation.",
+    })
+    SaveOrderDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+        Namespace: namespace,
+        Name: "save_order_duration_seconds",
+        Help: "SaveOrder latency, including pool token wait.",
+        Buckets: prometheus.DefBuckets,
+    })
+    SaveOrderFailures = promauto.NewCounter(prometheus.CounterOpts{
+        Namespace: namespace,
+        Name: "save_order_failures_total",
+        Help: "Orders not saved because of db errors.",
+    })
+
+    // cache
+    CacheHits = promauto.NewCounter(prometheus.CounterOpts{
+        Namespace: namespace,
+        Name: "cache_hits_total",
+        Help: "Cache lookups served from memory.",
+    })
+    CacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+        Namespace: namespace,
+        Name: "cache_misses_total",
+        Help: "Cache lookups not found in memory.",
+    })
+    CacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+        Namespace: namespace,
+        Name: "cache_evictions_total",
+        Help: "Items evicted from cache.",
+    })
+    CacheOversized = promauto.NewCounter(prometheus.CounterOpts{
+        Namespace: namespace,
+        Name: "cache_oversized_total",
+        Help: "Payloads not cached because of max_entry_bytes.",
+    })
+    CacheLoads = promauto.NewCounterVec(prometheus.CounterOpts{
+        Namespace: namespace,
+        Name: "cache_loads_total",
+        Help: "Cache loads from db by result.",
+    }, []string{"result"})
+    CacheLoadsShared = promauto.NewCounter(prometheus.CounterOpts{
+        Namespace: namespace,
+        Name: "cache_loads_shared_total",
+        Help: "Cache lookups served by load shared with concurrent callers.",
+    })
+    CacheNegativeHits = promauto.NewCounter(prometheus.CounterOpts{
+        Namespace: namespace,
+        Name: "cache_negative_hits_total",
+        Help: "Lookups answered from negative cache of not found orders.",
+    })
+    CacheLogOverflow = promauto.NewCounter(prometheus.CounterOpts{
+        Namespace: namespace,
+        Name: "cache_log_overflow_total",
+        Help: "Cache log writes hit pending keys limit.",
+    })
+
+    CacheL2Requests = promauto.NewCounterVec(prometheus.CounterOpts{
+        Namespace: namespace,
+        Name: "cache_l2_requests_total",
+        Help: "L2 cache requests by result.",
+    }, []string{"result"})
+    CacheL2Breaker = promauto.NewGauge(prometheus.GaugeOpts{
+        Namespace: namespace,
+        Name: "cache_l2_breaker_state",
+        Help: "L2 circuit breaker state: 0 closed, 1 open, 2 half open.",
+    })
+    CacheSnapshotDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+        Namespace: namespace,
+        Name: "cache_snapshot_duration_seconds",
+        Help: "Cache snapshot write latency.",
+        Buckets: prometheus.DefBuckets,
+    })
+
+    // cache log sync
+    MarkDumpedBatch = promauto.NewHistogram(prometheus.HistogramOpts{
+        Namespace: namespace,
+        Name: "mark_dumped_batch_size",
+        Help: "Cache log records written by one MarkDumped call.",
+        Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+    })
+    MarkDumpedDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+        Namespace: namespace,
+        Name: "mark_dumped_duration_seconds",
+        Help: "MarkDumped transaction latency.",
+        Buckets: prometheus.DefBuckets,
+    })
+
+    // live feed
+    FeedDisconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+        Namespace: namespace,
+        Name: "feed_disconnects_total",
+        Help: "Feed subscribers dropped by server, by reason.",
+    }, []string{"reason"})
+
+    // http
+    HTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+        Namespace: namespace,
+        Name: "http_request_duration_seconds",
+        Help: "HTTP request latency by route and status.",
+        Buckets: prometheus.DefBuckets,
+    }, []string{"method", "route", "status"})
+)
+
+// value is read on each scrape
+func RegisterGauge(name string, help string, fn func() float64) {
+    promauto.NewGaugeFunc(prometheus.GaugeOpts{
+        Namespace: namespace,
+        Name: name,
+        Help: help,
+    }, fn)
+}
+
+// monotonic value is read on each scrape
+func RegisterCounter(name string, help string, fn func() float64) {
+    promauto.NewCounterFunc(prometheus.CounterOpts{
+        Namespace: namespace,
+        Name: name,
+        Help: help,
+    }, fn)
+}
+
+func Handler() http.Handler {
+    return promhttp.Handler()
+}
+
+// measure request latency, route pattern is used
+// as label to keep cardinality low
+func HTTPMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+        start := time.Now()
+        ww := middleware.NewWrapResponseWriter(wr, req.ProtoMajor)
+        next.ServeHTTP(ww, req)
+        route := "unknown"
+        if rctx := chi.RouteContext(req.Context()); rctx != nil && rctx.RoutePattern() != "" {
+            route = rctx.RoutePattern()
+        }
+        status := ww.Status()
+        if status == 0 {
+            status = http.StatusOK
+        }
+        HTTPDuration.WithLabelValues(req.Method, route, strconv.Itoa(status)).
+            Observe(time.Since(start).Seconds())
+    })
+}
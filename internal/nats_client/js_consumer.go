@@ -0,0 +1,390 @@
+package nats_client
+
+import (
+    "fmt"
+    "os"
+    "errors"
+    "time"
+    "log/slog"
+    "context"
+    "sync"
+
+    "github.com/nats-io/nats.go"
+
+    "nats_app/internal/services"
+    "nats_app/internal/config"
+)
+
+const (
+    StanBroker string = "stan"
+    JetStreamBroker string = "jetstream"
+    defaultFetchBatch int = 32
+    defaultFetchTimeout time.Duration = 5 * time.Second
+    defaultFetchBackoff time.Duration = time.Second
+    defaultFetchMaxBackoff time.Duration = 30 * time.Second
+    defaultFetchMaxFailures int = 10
+)
+
+var (
+    AlreadySubscribed = errors.New("Subscription already created")
+)
+
+// ingestion pipeline, *services.AppStorage in app
+type ingester interface {
+    Ingest(msg services.InMsg) error
+}
+
+// pull side of subscription, *nats.Subscription in app
+type fetcher interface {
+    Fetch(batch int, opts ...nats.PullOpt) ([]*nats.Msg, error)
+}
+
+// JetStream durable pull consumer with explicit ack
+type JSConsumer struct {
+    nc *nats.Conn
+    js nats.JetStreamContext
+    // guards sub, fetch loop gets its own copy
+    mu sync.Mutex
+    sub *nats.Subscription
+    stream string
+    subject string
+    dur_name string
+    ack_wt time.Duration
+    batch int
+    fetch_wt time.Duration
+    // delay after failed fetch, doubled up to max_backoff
+    backoff time.Duration
+    max_backoff time.Duration
+    // consecutive failed fetches before consumer is reported lost
+    max_failures int
+    store ingester
+    logger *slog.Logger
+    errCh chan<- error
+    ctx context.Context
+    // stops fetch loop
+    stop func()
+    wg sync.WaitGroup
+}
+
+func (jc *JSConsumer) SetLogger(l *slog.Logger) {
+    jc.logger = l
+}
+
+func (jc *JSConsumer) SetStorageOnCallback(s *services.AppStorage) {
+    store := *s
+    jc.store = &store
+}
+
+func (jc *JSConsumer) log() *slog.Logger {
+    if jc.logger == nil {
+        // setup logger at place
+        jc.logger = slog.New(
+            slog.NewTextHandler(
+                os.Stdout,
+                &slog.HandlerOptions{Level: slog.LevelDebug},
+            ),
+        )
+    }
+    return jc.logger
+}
+
+// create stream if not exists, useful for embedded server
+func (jc *JSConsumer) ensureStream() error {
+    mark := "JSConsumer.ensureStream"
+    _, err := jc.js.StreamInfo(jc.stream)
+    if err == nil {
+        return nil
+    }
+    if !errors.Is(err, nats.ErrStreamNotFound) {
+        return fmt.Errorf("%s | Error: %w", mark, err)
+    }
+    _, err = jc.js.AddStream(&nats.StreamConfig{
+        Name: jc.stream,
+        Subjects: []string{jc.subject},
+    })
+    if err != nil {
+        return fmt.Errorf("%s | Can`t create stream %s. Error: %w", mark, jc.stream, err)
+    }
+    return nil
+}
+
+// existing durable resumes from its own position,
+// start option is used only for new one.
+func (jc *JSConsumer) subscribe(start nats.SubOpt) error {
+    mark := "JSConsumer.subscribe"
+    jc.mu.Lock()
+    defer jc.mu.Unlock()
+    if jc.sub != nil {
+        return AlreadySubscribed
+    }
+    if jc.store == nil {
+        return fmt.Errorf("%s | Storage is not set", mark)
+    }
+    if err := jc.ensureStream(); err != nil {
+        return err
+    }
+    opts := []nats.SubOpt{nats.Bind(jc.stream, jc.dur_name)}
+    _, err := jc.js.ConsumerInfo(jc.stream, jc.dur_name)
+    if errors.Is(err, nats.ErrConsumerNotFound) {
+        opts = []nats.SubOpt{
+            nats.BindStream(jc.stream),
+            nats.AckExplicit(),
+            nats.AckWait(jc.ack_wt),
+            start,
+        }
+    } else if err != nil {
+        return fmt.Errorf("%s | Error: %w", mark, err)
+    }
+    sub, err := jc.js.PullSubscribe(jc.subject, jc.dur_name, opts...)
+    if err != nil {
+        return fmt.Errorf("%s | Can`t subscribe %s. Error: %w", mark, jc.subject, err)
+    }
+    jc.sub = sub
+    ctx, cancel := context.WithCancel(jc.ctx)
+    jc.stop = cancel
+    jc.wg.Add(1)
+    go jc.fetchLoop(ctx, sub)
+    return nil
+}
+
+func (jc *JSConsumer) fetchLoop(ctx context.Context, sub fetcher) {
+    defer jc.wg.Done()
+    mark := "JSConsumer.fetchLoop"
+    delay := jc.backoff
+    failures := 0
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        default:
+        }
+        msgs, err := sub.Fetch(jc.batch, nats.MaxWait(jc.fetch_wt))
+        if errors.Is(err, nats.ErrTimeout) {
+            delay, failures = jc.backoff, 0
+            continue
+        }
+        if err != nil {
+            if errors.Is(err, nats.ErrBadSubscription) || errors.Is(err, nats.ErrConnectionClosed) {
+                if ctx.Err() != nil {
+                    return
+                }
+                select {
+                case jc.errCh<- services.NewConsumerDisconnected(mark, err):
+                case <-ctx.Done():
+                }
+                return
+            }
+            failures++
+            if failures >= jc.max_failures {
+                // stream deleted, no permissions etc.,
+                // supervisor resubscribes
+                err = fmt.Errorf("%s | %d fetches failed. Last error: %w", mark, failures, err)
+                select {
+                case jc.errCh<- services.NewConsumerDisconnected(mark, err):
+                case <-ctx.Done():
+                }
+                return
+            }
+            err = fmt.Errorf("%s | Fetch error: %w", mark, err)
+            select {
+            case jc.errCh<- err:
+            case <-ctx.Done():
+                return
+            }
+            jc.log().Warn(fmt.Sprintf("%s | Attempt %d failed, next fetch in %s", mark, failures, delay))
+            select {
+            case <-ctx.Done():
+                return
+            case <-time.After(delay):
+            }
+            delay *= 2
+            if delay > jc.max_backoff {
+                delay = jc.max_backoff
+            }
+            continue
+        }
+        delay, failures = jc.backoff, 0
+        for _, msg := range msgs {
+            jc.handle(ctx, msg)
+        }
+    }
+}
+
+// send message into ingestion pipeline,
+// ack is called after db commit.
+func (jc *JSConsumer) handle(ctx context.Context, msg *nats.Msg) {
+    mark := "JSConsumer.Callback"
+    meta, err := msg.Metadata()
+    if err != nil {
+        jc.log().Error(fmt.Sprintf("%s | Not a JetStream message: %s", mark, err.Error()))
+        return
+    }
+    err = jc.store.Ingest(services.InMsg{
+        Subject: msg.Subject,
+        Sequence: meta.Sequence.Stream,
+        Timestamp: meta.Timestamp,
+        Data: msg.Data,
+        Ack: func() error {return msg.Ack()},
+    })
+    if err != nil {
+        err = fmt.Errorf("%s: %w", mark, err)
+        jc.log().Debug(fmt.Sprintf("%s | Error: %+v", mark, err))
+        select {
+        case jc.errCh<- err:
+        case <-ctx.Done():
+        }
+        return
+    }
+    report := fmt.Sprintf("%s | Order sent to DB. Subject [%s], MsgNum [%d]...", mark, msg.Subject, meta.Sequence.Stream)
+    jc.log().Debug(report)
+}
+
+// will read all available messages
+func (jc *JSConsumer) Run() error {
+    return jc.subscribe(nats.DeliverAll())
+}
+
+func (jc *JSConsumer) RunFromSequence(seq uint64) error {
+    return jc.subscribe(nats.StartSequence(seq))
+}
+
+func (jc *JSConsumer) RunFromTimestamp(ts time.Time) error {
+    return jc.subscribe(nats.StartTime(ts))
+}
+
+// stop fetching and wait for current batch
+func (jc *JSConsumer) halt() {
+    jc.mu.Lock()
+    stop := jc.stop
+    jc.mu.Unlock()
+    if stop != nil {
+        stop()
+    }
+    jc.wg.Wait()
+}
+
+// stop fetching and forget subscription, durable stays on server
+func (jc *JSConsumer) release() *nats.Subscription {
+    jc.halt()
+    jc.mu.Lock()
+    defer jc.mu.Unlock()
+    sub := jc.sub
+    jc.sub = nil
+    return sub
+}
+
+func (jc *JSConsumer) Resubscribe(seq uint64) error {
+    jc.release()
+    return jc.RunFromSequence(seq)
+}
+
+func (jc *JSConsumer) State() ConsumerState {
+    jc.mu.Lock()
+    sub := jc.sub
+    jc.mu.Unlock()
+    return ConsumerState{
+        Broker: JetStreamBroker,
+        Connected: jc.nc.IsConnected(),
+        Subscribed: sub != nil && sub.IsValid(),
+    }
+}
+
+func (jc *JSConsumer) Stop() {
+    jc.halt()
+}
+
+// stop fetching and remove durable consumer
+func (jc *JSConsumer) Unsubscribe() error {
+    mark := "JSConsumer.Unsubscribe"
+    sub := jc.release()
+    if sub == nil {
+        return NoSubscription
+    }
+    if err := sub.Unsubscribe(); err != nil {
+        return fmt.Errorf("%s | Error: %w", mark, err)
+    }
+    return nil
+}
+
+// stop fetching and close connection, durable stays on server
+func (jc *JSConsumer) Disconnect() error {
+    jc.release()
+    jc.nc.Close()
+    return nil
+}
+
+// build consumer on top of existing connection,
+// e.g. embedded server in tests
+func NewJetStreamConsumerFromConn(
+        ctx context.Context,
+        errch chan<- error,
+        conn *nats.Conn,
+        s *config.JetStreamConfig,
+    ) (*JSConsumer, error) {
+    mark := "NewJetStreamConsumer"
+    if s.Stream == "" || s.Subject == "" || s.DurableName == "" {
+        return nil, fmt.Errorf(
+            "%s | Invalid settings: stream = %s; subject = %s; durable_name = %s",
+            mark,
+            s.Stream,
+            s.Subject,
+            s.DurableName,
+        )
+    }
+    js, err := conn.JetStream()
+    if err != nil {
+        return nil, fmt.Errorf("%s | JetStream not available. Error: %w", mark, err)
+    }
+    jc := &JSConsumer{
+        nc:             conn,
+        js:             js,
+        stream:         s.Stream,
+        subject:        s.Subject,
+        dur_name:       s.DurableName,
+        ack_wt:         s.AckWait,
+        batch:          s.FetchBatch,
+        fetch_wt:       s.FetchTimeout,
+        backoff:        s.FetchBackoff,
+        max_backoff:    s.FetchMaxBackoff,
+        max_failures:   s.FetchMaxFailures,
+        errCh:          errch,
+        ctx:            ctx,
+    }
+    if jc.batch <= 0 {
+        jc.batch = defaultFetchBatch
+    }
+    if jc.fetch_wt <= 0 {
+        jc.fetch_wt = defaultFetchTimeout
+    }
+    if jc.backoff <= 0 {
+        jc.backoff = defaultFetchBackoff
+    }
+    if jc.max_backoff <= 0 {
+        jc.max_backoff = defaultFetchMaxBackoff
+    }
+    if jc.max_backoff < jc.backoff {
+        jc.max_backoff = jc.backoff
+    }
+    if jc.max_failures <= 0 {
+        jc.max_failures = defaultFetchMaxFailures
+    }
+    return jc, nil
+}
+
+func NewJetStreamConsumer(
+        ctx context.Context,
+        errch chan<- error,
+        s *config.JetStreamConfig,
+    ) (*JSConsumer, error) {
+    mark := "NewJetStreamConsumer"
+    conn, err := nats.Connect(s.Url)
+    if err != nil {
+        return nil, fmt.Errorf("%s | Can`t connect to server. Error: %w", mark, err)
+    }
+    jc, err := NewJetStreamConsumerFromConn(ctx, errch, conn, s)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    return jc, nil
+}
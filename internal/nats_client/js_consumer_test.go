@@ -0,0 +1,319 @@
+package nats_client
+
+import (
+    "context"
+    "errors"
+    "io"
+    "log/slog"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/nats-io/nats-server/v2/server"
+    "github.com/nats-io/nats.go"
+
+    "nats_app/internal/config"
+    "nats_app/internal/services"
+)
+
+const (
+    testStream string = "ORDERS"
+    testSubject string = "orders.new"
+)
+
+func runJetStream(t *testing.T) *server.Server {
+    t.Helper()
+    srv, err := server.NewServer(&server.Options{
+        Host: "127.0.0.1",
+        Port: -1,
+        JetStream: true,
+        StoreDir: t.TempDir(),
+        NoLog: true,
+        NoSigs: true,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    go srv.Start()
+    if !srv.ReadyForConnections(5 * time.Second) {
+        t.Fatal("nats server is not ready")
+    }
+    t.Cleanup(srv.Shutdown)
+    return srv
+}
+
+func connect(t *testing.T, srv *server.Server) *nats.Conn {
+    t.Helper()
+    nc, err := nats.Connect(srv.ClientURL())
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(nc.Close)
+    return nc
+}
+
+// publish count messages, returns time before each one
+func publish(t *testing.T, nc *nats.Conn, count int) []time.Time {
+    t.Helper()
+    js, err := nc.JetStream()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err = js.StreamInfo(testStream); err != nil {
+        _, err = js.AddStream(&nats.StreamConfig{Name: testStream, Subjects: []string{testSubject}})
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    sent := make([]time.Time, 0, count)
+    for i := 0; i < count; i++ {
+        sent = append(sent, time.Now())
+        if _, err = js.Publish(testSubject, []byte(`{}`)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return sent
+}
+
+// fake ingestion: records sequences, acks unless skip says no
+type recorder struct {
+    mu sync.Mutex
+    got chan uint64
+    // return true to leave message not acked
+    skip func(seq uint64, delivery int) bool
+    deliveries map[uint64]int
+}
+
+func newRecorder() *recorder {
+    return &recorder{got: make(chan uint64, 64), deliveries: make(map[uint64]int)}
+}
+
+func (r *recorder) Ingest(msg services.InMsg) error {
+    r.mu.Lock()
+    r.deliveries[msg.Sequence]++
+    n := r.deliveries[msg.Sequence]
+    r.mu.Unlock()
+    if r.skip == nil || !r.skip(msg.Sequence, n) {
+        if err := msg.Ack(); err != nil {
+            return err
+        }
+    }
+    r.got<- msg.Sequence
+    return nil
+}
+
+func (r *recorder) expect(t *testing.T, want ...uint64) {
+    t.Helper()
+    for i, seq := range want {
+        select {
+        case got := <-r.got:
+            if got != seq {
+                t.Fatalf("message %d: seq %d, want %d", i, got, seq)
+            }
+        case <-time.After(5 * time.Second):
+            t.Fatalf("message %d: seq %d is not delivered", i, seq)
+        }
+    }
+    select {
+    case got := <-r.got:
+        t.Fatalf("unexpected seq %d", got)
+    case <-time.After(100 * time.Millisecond):
+    }
+}
+
+func newTestConsumer(t *testing.T, nc *nats.Conn, rec *recorder, ackWait time.Duration) *JSConsumer {
+    t.Helper()
+    errCh := make(chan error, 16)
+    jc, err := NewJetStreamConsumerFromConn(context.Background(), errCh, nc, &config.JetStreamConfig{
+        Stream: testStream,
+        Subject: testSubject,
+        DurableName: "test-durable",
+        AckWait: ackWait,
+        FetchBatch: 8,
+        FetchTimeout: 100 * time.Millisecond,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    jc.SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+    jc.store = rec
+    t.Cleanup(func() {jc.Disconnect()})
+    return jc
+}
+
+func TestJSConsumerSettings(t *testing.T) {
+    srv := runJetStream(t)
+    nc := connect(t, srv)
+    _, err := NewJetStreamConsumerFromConn(context.Background(), nil, nc, &config.JetStreamConfig{Stream: testStream})
+    if err == nil {
+        t.Fatal("empty subject and durable name accepted")
+    }
+}
+
+func TestJSConsumerDurablePull(t *testing.T) {
+    srv := runJetStream(t)
+    publish(t, connect(t, srv), 3)
+
+    rec := newRecorder()
+    jc := newTestConsumer(t, connect(t, srv), rec, 30 * time.Second)
+    if err := jc.Run(); err != nil {
+        t.Fatal(err)
+    }
+    if err := jc.Run(); err != AlreadySubscribed {
+        t.Fatalf("second Run: %v", err)
+    }
+    rec.expect(t, 1, 2, 3)
+    if st := jc.State(); !st.Connected || !st.Subscribed {
+        t.Fatalf("state after run: %+v", st)
+    }
+    if err := jc.Disconnect(); err != nil {
+        t.Fatal(err)
+    }
+    if st := jc.State(); st.Connected || st.Subscribed {
+        t.Fatalf("state after disconnect: %+v", st)
+    }
+
+    // durable keeps position, start option is ignored
+    publish(t, connect(t, srv), 2)
+    rec2 := newRecorder()
+    jc2 := newTestConsumer(t, connect(t, srv), rec2, 30 * time.Second)
+    if err := jc2.Run(); err != nil {
+        t.Fatal(err)
+    }
+    rec2.expect(t, 4, 5)
+}
+
+func TestJSConsumerExplicitAck(t *testing.T) {
+    srv := runJetStream(t)
+    publish(t, connect(t, srv), 2)
+
+    rec := newRecorder()
+    // first delivery of seq 1 is not acked: db failed
+    rec.skip = func(seq uint64, delivery int) bool {return seq == 1 && delivery == 1}
+    jc := newTestConsumer(t, connect(t, srv), rec, 500 * time.Millisecond)
+    if err := jc.Run(); err != nil {
+        t.Fatal(err)
+    }
+    // redelivered after ack wait
+    rec.expect(t, 1, 2, 1)
+
+    info, err := jc.js.ConsumerInfo(testStream, "test-durable")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if info.NumAckPending != 0 || info.AckFloor.Stream != 2 {
+        t.Fatalf("ack pending %d, ack floor %d", info.NumAckPending, info.AckFloor.Stream)
+    }
+}
+
+func TestJSConsumerStartPosition(t *testing.T) {
+    cases := []struct {
+        name string
+        run func(jc *JSConsumer, sent []time.Time) error
+        want []uint64
+    }{
+        {
+            name: "all",
+            run: func(jc *JSConsumer, _ []time.Time) error {return jc.Run()},
+            want: []uint64{1, 2, 3, 4},
+        },
+        {
+            name: "by sequence",
+            run: func(jc *JSConsumer, _ []time.Time) error {return jc.RunFromSequence(3)},
+            want: []uint64{3, 4},
+        },
+        {
+            name: "by time",
+            run: func(jc *JSConsumer, sent []time.Time) error {return jc.RunFromTimestamp(sent[2])},
+            want: []uint64{3, 4},
+        },
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            srv := runJetStream(t)
+            nc := connect(t, srv)
+            sent := publish(t, nc, 2)
+            // start time must fall between messages
+            time.Sleep(50 * time.Millisecond)
+            sent = append(sent, publish(t, nc, 2)...)
+
+            rec := newRecorder()
+            jc := newTestConsumer(t, connect(t, srv), rec, 30 * time.Second)
+            if err := tc.run(jc, sent); err != nil {
+                t.Fatal(err)
+            }
+            rec.expect(t, tc.want...)
+        })
+    }
+}
+
+func TestJSConsumerUnsubscribe(t *testing.T) {
+    srv := runJetStream(t)
+    publish(t, connect(t, srv), 3)
+
+    rec := newRecorder()
+    jc := newTestConsumer(t, connect(t, srv), rec, 30 * time.Second)
+    if err := jc.RunFromSequence(3); err != nil {
+        t.Fatal(err)
+    }
+    rec.expect(t, 3)
+    // durable is removed, new one starts from requested seq
+    if err := jc.Unsubscribe(); err != nil {
+        t.Fatal(err)
+    }
+    if err := jc.Unsubscribe(); err != NoSubscription {
+        t.Fatalf("second Unsubscribe: %v", err)
+    }
+    if err := jc.Resubscribe(2); err != nil {
+        t.Fatal(err)
+    }
+    rec.expect(t, 2, 3)
+}
+
+// fetch always fails, e.g. no permissions
+type failingFetch struct {
+    calls chan time.Time
+}
+
+func (f *failingFetch) Fetch(batch int, opts ...nats.PullOpt) ([]*nats.Msg, error) {
+    f.calls<- time.Now()
+    return nil, errors.New("nats: permissions violation")
+}
+
+// failing fetch is retried with backoff, consumer
+// is reported lost after max_failures in a row
+func TestJSConsumerFetchBackoff(t *testing.T) {
+    errCh := make(chan error, 16)
+    jc := &JSConsumer{
+        backoff: 20 * time.Millisecond,
+        max_backoff: 50 * time.Millisecond,
+        max_failures: 5,
+        errCh: errCh,
+    }
+    jc.SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+    f := &failingFetch{calls: make(chan time.Time, 16)}
+    jc.wg.Add(1)
+    go jc.fetchLoop(context.Background(), f)
+    jc.wg.Wait()
+
+    var lost *services.ConsumerDisconnected
+    for i := 0; i < 5; i++ {
+        err := <-errCh
+        if last := i == 4; errors.As(err, &lost) != last {
+            t.Fatalf("error %d: %v", i, err)
+        }
+    }
+    // 20ms, 40ms, then capped to 50ms
+    want := []time.Duration{20, 40, 50, 50}
+    prev := <-f.calls
+    for i, d := range want {
+        call := <-f.calls
+        if gap := call.Sub(prev); gap < d * time.Millisecond {
+            t.Fatalf("fetch %d after %s, want %dms", i + 1, gap, d)
+        }
+        prev = call
+    }
+    if len(f.calls) != 0 {
+        t.Fatalf("%d fetches after consumer lost", len(f.calls))
+    }
+}
@@ -4,16 +4,15 @@ import (
     "fmt"
     "os"
     "errors"
+    "strings"
     "time"
-    "log"
     "log/slog"
-    "encoding/json"
     "context"
+    "sync"
+    "sync/atomic"
 
     stan "github.com/nats-io/stan.go"
-    valid "github.com/go-playground/validator/v10"
 
-    "nats_app/internal/storage"
     "nats_app/internal/services"
     "nats_app/internal/config"
 )
@@ -31,39 +30,77 @@ var (
     NoSubscription = errors.New("No subscription created")
 )
 
+// broker subscription, implemented for
+// NATS Streaming (AppConsumer) and JetStream (JSConsumer)
 type Subscriber interface {
-    SetStorageOnCallback(s services.AppStorage)
-    SetLogger(l slog.Logger)
-    RunFromLastId(id uint64)
-    RunFromTimestamp(t time.Time)
-    Run()
+    SetStorageOnCallback(s *services.AppStorage)
+    SetLogger(l *slog.Logger)
+    // read all available messages
+    Run() error
+    RunFromSequence(seq uint64) error
+    RunFromTimestamp(ts time.Time) error
+    // close current subscription and subscribe from sequence
+    Resubscribe(seq uint64) error
+    // stop taking new messages, in-flight ones
+    // can still be acked until Disconnect
+    Stop()
     Unsubscribe() error
+    // close subscription (durable stays on server) and connection
     Disconnect() error
+    State() ConsumerState
 }
 
+// connection and subscription state for health checks
+type ConsumerState struct {
+    Broker string `json:"broker"`
+    Connected bool `json:"connected"`
+    Subscribed bool `json:"subscribed"`
+    Reconnecting bool `json:"reconnecting"`
+    // successful reconnects since start
+    Reconnects uint64 `json:"reconnects"`
+    LastError string `json:"last_error,omitempty"`
+}
+
+var (
+    _ Subscriber = (*AppConsumer)(nil)
+    _ Subscriber = (*JSConsumer)(nil)
+)
+
 type AppConsumer struct {
     s stan.Conn
     sub stan.Subscription
     ask_wt time.Duration
     dur_name string
     channel string
+    group string
     callback func(msg *stan.Msg)
     logger *slog.Logger
     errCh chan<- error
     ctx context.Context
+    stopped atomic.Bool
+    conf *config.StanConfig
+    store *services.AppStorage
+    // guards connection and subscription,
+    // both are replaced on reconnect
+    mu sync.Mutex
+    reconnecting atomic.Bool
+    reconnects atomic.Uint64
+    lostErr error
+    quit chan struct{}
+    quitOnce sync.Once
+    wg sync.WaitGroup
 }
 
-func (nc AppConsumer) SetLogger(l *slog.Logger) {
+func (nc *AppConsumer) SetLogger(l *slog.Logger) {
     nc.logger = l
 }
 
 // called as go routine separately (inside stan)
 func (nc *AppConsumer) SetStorageOnCallback(s *services.AppStorage) {
-    cons := *nc
-    val := valid.New()
+    cons := nc
     store := *s
+    nc.store = &store
     nc.callback = func(msg *stan.Msg) {
-        var ordModel storage.CustomerOrder
         var errType error
         log := cons.logger
         if log == nil {
@@ -76,45 +113,35 @@ func (nc *AppConsumer) SetStorageOnCallback(s *services.AppStorage) {
             )
         }
         mark := "AppConsumer.Callback"
+        if cons.stopped.Load() {
+            // not acked, will be redelivered after restart
+            return
+        }
         select {
         case <-cons.ctx.Done():
-            cons.sub.Close()
+            cons.closeSub()
             return
         default:
-            errType = json.Unmarshal((*msg).Data, &ordModel)
-            if errType != nil {
-                errType = fmt.Errorf(
-                "%s: msg_id %d, error: %w",
-                mark,
-                (*msg).Sequence,
-                errType,
-            )
-            } else {
-                if errType = val.Struct(ordModel); errType != nil {
-                    errType = fmt.Errorf(
-                        "%s: msg_id %d, Validation error: %w",
-                        mark,
-                        (*msg).Sequence,
-                        errType,
-                    )
-                }
-            }
+            // ack after db commit, failed orders will be redelivered,
+            // invalid ones are moved to dead letters
+            errType = store.Ingest(services.InMsg{
+                Subject: (*msg).Subject,
+                Sequence: (*msg).Sequence,
+                Timestamp: time.Unix(0, (*msg).Timestamp),
+                Data: (*msg).Data,
+                Ack: msg.Ack,
+            })
             if errType != nil {
+                errType = fmt.Errorf("%s: %w", mark, errType)
                 log.Debug(fmt.Sprintf("%s | Error: %+v", mark, errType))
                 select {
                 case cons.errCh<- errType:
                     return
                 case <-cons.ctx.Done():
-                    cons.sub.Close()
+                    cons.closeSub()
                     return
                 }
             }
-            msgForStorage := store.Convert(
-                    (*msg).Sequence,
-                    ordModel.Order_id,
-                    &(*msg).Data,
-                )
-            store.SaveOrder(msgForStorage)
             report := fmt.Sprintf("%s | Order sent to DB. Client [%s], MsgNum [%d]...", mark, (*msg).Subject, (*msg).Sequence) 
             log.Debug(report)
             return
@@ -123,55 +150,48 @@ func (nc *AppConsumer) SetStorageOnCallback(s *services.AppStorage) {
 }
 
 // will read messages from last received
-func (nc AppConsumer) RunFromLastReseived() error {
-    mark := "AppConsumer.RunFromLastReseived"
-    var sub stan.Subscription
-    var subErr error
-    sub, subErr = nc.s.Subscribe(
-        nc.channel,
-        nc.callback,
-        stan.DurableName(nc.dur_name),
-        stan.StartWithLastReceived(),
-        stan.AckWait(nc.ask_wt),
-    )
-    if subErr != nil {
-        return fmt.Errorf("%s | Can`t subscribe %s. Error: %w", mark, nc.channel, subErr)
-    }
-    nc.sub = sub
-    return nil
+func (nc *AppConsumer) RunFromLastReseived() error {
+    return nc.subscribe("AppConsumer.RunFromLastReseived", stan.StartWithLastReceived())
 }
 
 // will read messages from timestamp
-func (nc AppConsumer) RunFromTimestamp(ts time.Time) error {
-    mark := "AppConsumer.RunFromTimestamp"
-    var sub stan.Subscription
-    var subErr error
-    sub, subErr = nc.s.Subscribe(
-        nc.channel,
-        nc.callback,
-        stan.StartAtTime(ts),
-        stan.DurableName(nc.dur_name),
-        stan.AckWait(nc.ask_wt),
-    )
-    if subErr != nil {
-        return fmt.Errorf("%s | Can`t subscribe %s. Error: %w", mark, nc.channel, subErr)
-    }
-    nc.sub = sub
-    return nil
+func (nc *AppConsumer) RunFromTimestamp(ts time.Time) error {
+    return nc.subscribe("AppConsumer.RunFromTimestamp", stan.StartAtTime(ts))
+}
+
+// will read messages starting from sequence.
+// Server resumes existing durable subscription
+// from its own position, sequence is used for new one.
+func (nc *AppConsumer) RunFromSequence(seq uint64) error {
+    return nc.subscribe("AppConsumer.RunFromSequence", stan.StartAtSequence(seq))
 }
 
 // will read all available messages
-func (nc AppConsumer) Run() error {
-    mark := "AppConsumer.Run"
-    var sub stan.Subscription
-    var subErr error
-    sub, subErr = nc.s.Subscribe(
-        nc.channel,
-        nc.callback,
-        stan.DeliverAllAvailable(),
+func (nc *AppConsumer) Run() error {
+    return nc.subscribe("AppConsumer.Run", stan.DeliverAllAvailable())
+}
+
+func (nc *AppConsumer) subscribe(mark string, start stan.SubscriptionOption) error {
+    nc.mu.Lock()
+    defer nc.mu.Unlock()
+    if nc.s == nil {
+        return fmt.Errorf("%s | Error: %w", mark, NatsConnFail)
+    }
+    opts := []stan.SubscriptionOption{
+        start,
         stan.DurableName(nc.dur_name),
         stan.AckWait(nc.ask_wt),
-    )
+        stan.SetManualAckMode(),
+    }
+    var sub stan.Subscription
+    var subErr error
+    if nc.group == "" {
+        sub, subErr = nc.s.Subscribe(nc.channel, nc.callback, opts...)
+    } else {
+        // durable queue group, start position is used
+        // only when group is created
+        sub, subErr = nc.s.QueueSubscribe(nc.channel, nc.group, nc.callback, opts...)
+    }
     if subErr != nil {
         return fmt.Errorf("%s | Can`t subscribe %s. Error: %w", mark, nc.channel, subErr)
     }
@@ -179,8 +199,20 @@ func (nc AppConsumer) Run() error {
     return nil
 }
 
-func (nc AppConsumer) Unsubscribe() error {
+// close subscription on shutdown, durable stays on server
+func (nc *AppConsumer) closeSub() {
+    nc.mu.Lock()
+    defer nc.mu.Unlock()
+    if nc.sub != nil {
+        nc.sub.Close()
+        nc.sub = nil
+    }
+}
+
+func (nc *AppConsumer) Unsubscribe() error {
     mark := "AppConsumer.Unsubscribe"
+    nc.mu.Lock()
+    defer nc.mu.Unlock()
     if nc.sub == nil {
         return NoSubscription
     }
@@ -192,47 +224,251 @@ func (nc AppConsumer) Unsubscribe() error {
     return nil
 }
 
-func (nc AppConsumer) Disconnect() error {
+func (nc *AppConsumer) Resubscribe(seq uint64) error {
+    nc.closeSub()
+    return nc.RunFromSequence(seq)
+}
+
+func (nc *AppConsumer) State() ConsumerState {
+    nc.mu.Lock()
+    defer nc.mu.Unlock()
+    state := ConsumerState{
+        Broker: StanBroker,
+        Connected: nc.s != nil && nc.s.NatsConn() != nil && nc.s.NatsConn().IsConnected(),
+        Subscribed: nc.sub != nil && !nc.stopped.Load(),
+        Reconnecting: nc.reconnecting.Load(),
+        Reconnects: nc.reconnects.Load(),
+    }
+    if nc.lostErr != nil {
+        state.LastError = nc.lostErr.Error()
+    }
+    return state
+}
+
+func (nc *AppConsumer) Stop() {
+    nc.stopped.Store(true)
+}
+
+func (nc *AppConsumer) Disconnect() error {
     mark := "AppConsumer.Disconnect"
-    if nc.sub == nil {
-        return NoSubscription
+    nc.Stop()
+    // stop reconnect loop first, it can replace connection
+    nc.quitOnce.Do(func() {close(nc.quit)})
+    nc.wg.Wait()
+    nc.mu.Lock()
+    defer nc.mu.Unlock()
+    var err error
+    if nc.sub != nil {
+        err = nc.sub.Close()
+        nc.sub = nil
+    }
+    if nc.s != nil {
+        if ConnErr := nc.s.Close(); ConnErr != nil && err == nil {
+            err = ConnErr
+        }
+        nc.s = nil
     }
-    err := nc.sub.Close()
     if err != nil {
         return fmt.Errorf("%s | Error: %w", mark, err)
     }
-    nc.sub = nil
     return nil
 }
 
+// called by stan when pings are not answered
+// or client is replaced on server
+func (nc *AppConsumer) onConnectionLost(conn stan.Conn, reason error) {
+    mark := "AppConsumer.onConnectionLost"
+    nc.log().Error(fmt.Sprintf("%s | Connection lost: %s", mark, reason.Error()))
+    nc.mu.Lock()
+    if nc.s != conn {
+        // already replaced
+        nc.mu.Unlock()
+        return
+    }
+    nc.s = nil
+    nc.sub = nil
+    nc.lostErr = reason
+    nc.mu.Unlock()
+    select {
+    case <-nc.quit:
+        return
+    default:
+    }
+    if !nc.reconnecting.CompareAndSwap(false, true) {
+        return
+    }
+    nc.wg.Add(1)
+    go nc.reconnect()
+}
+
+// reconnect with backoff and recreate durable
+// subscription from last checkpoint
+func (nc *AppConsumer) reconnect() {
+    defer nc.wg.Done()
+    defer nc.reconnecting.Store(false)
+    mark := "AppConsumer.reconnect"
+    delay := nc.conf.ReconnectBackoff
+    for attempt := 1; ; attempt++ {
+        select {
+        case <-nc.ctx.Done():
+            return
+        case <-nc.quit:
+            return
+        case <-time.After(delay):
+        }
+        err := nc.restore()
+        if err == nil {
+            nc.reconnects.Add(1)
+            nc.log().Info(fmt.Sprintf("%s | Reconnected after %d attempt(s)...", mark, attempt))
+            return
+        }
+        nc.mu.Lock()
+        nc.lostErr = err
+        nc.mu.Unlock()
+        nc.log().Warn(fmt.Sprintf("%s | Attempt %d failed: %s", mark, attempt, err.Error()))
+        delay *= 2
+        if delay > nc.conf.ReconnectMaxBackoff {
+            delay = nc.conf.ReconnectMaxBackoff
+        }
+    }
+}
+
+func (nc *AppConsumer) restore() error {
+    mark := "AppConsumer.restore"
+    conn, err := connectStan(nc.conf, nc.onConnectionLost)
+    if err != nil {
+        return fmt.Errorf("%s | Can`t connect to server. Error: %w", mark, err)
+    }
+    nc.mu.Lock()
+    nc.s = conn
+    nc.lostErr = nil
+    nc.mu.Unlock()
+    var seq uint64
+    found := false
+    // store is set before run, but keep it safe
+    if nc.store != nil {
+        seq, found, err = nc.store.LastCheckpoint()
+    }
+    switch {
+    case err != nil:
+        err = fmt.Errorf("%s | Error: %w", mark, err)
+    case !found:
+        err = nc.Run()
+    default:
+        nc.log().Info(fmt.Sprintf("%s | Resume from checkpoint %d...", mark, seq))
+        err = nc.RunFromSequence(seq + 1)
+    }
+    if err != nil {
+        // next attempt will open new connection
+        nc.mu.Lock()
+        nc.s = nil
+        nc.mu.Unlock()
+        conn.Close()
+    }
+    return err
+}
+
+func (nc *AppConsumer) log() *slog.Logger {
+    if nc.logger == nil {
+        // setup logger at place
+        nc.logger = slog.New(
+            slog.NewTextHandler(
+                os.Stdout,
+                &slog.HandlerOptions{Level: slog.LevelDebug},
+            ),
+        )
+    }
+    return nc.logger
+}
+
+func connectStan(s *config.StanConfig, onLost stan.ConnectionLostHandler) (stan.Conn, error) {
+    // stan accepts ping interval in seconds
+    interval := int(s.PingInterval / time.Second)
+    if interval < 1 {
+        interval = 1
+    }
+    return stan.Connect(
+        s.Cluster_id,
+        s.Client_id,
+        stan.NatsURL(s.Url),
+        stan.Pings(interval, s.PingMaxOut),
+        stan.SetConnectionLostHandler(onLost),
+    )
+}
 
 func NewStanConsumer(
         ctx context.Context,
         errch chan<- error,
         s *config.StanConfig,
-    ) AppConsumer {
+    ) (*AppConsumer, error) {
     mark := "NewStanConsumer"
     if s.Cluster_id == "" || s.Client_id == "" {
-        msg := fmt.Sprintf(
+        return nil, fmt.Errorf(
             "%s | Invalid creadentials: cluster_id = %s; client_id = %s",
             mark,
             s.Cluster_id,
             s.Client_id,
         )
-        log.Fatal(msg)
-    }
-    conn, err := stan.Connect(s.Cluster_id, s.Client_id)
-    if err != nil {
-        err = fmt.Errorf("%s | Can`t connect to server. Error: %w", mark, err)
-        log.Fatal(err)
     }
-    return AppConsumer{
-        s:               conn,
+    nc := &AppConsumer{
         sub:                nil,
         ask_wt:             s.Ask_wt,
         ctx:                ctx,
         channel:            s.ChannelName,
         dur_name:           s.DurableName,
+        group:              s.QueueGroup,
+        conf:               s,
         errCh:              errch,
+        quit:               make(chan struct{}),
+    }
+    conn, err := connectStan(s, nc.onConnectionLost)
+    if err != nil {
+        return nil, fmt.Errorf("%s | Can`t connect to server. Error: %w", mark, err)
+    }
+    nc.s = conn
+    return nc, nil
+}
+
+// build subscriber for configured broker
+func NewSubscriber(
+        ctx context.Context,
+        errch chan<- error,
+        conf *config.AppConfig,
+    ) (Subscriber, error) {
+    switch conf.Broker {
+    case StanBroker, "":
+        sc := conf.StanConf
+        if sc.QueueGroup != "" {
+            // client id must be unique on server
+            sc.Client_id = fmt.Sprintf("%s-%s", sc.Client_id, clientIdPart(conf.InstanceId))
+        }
+        return NewStanConsumer(ctx, errch, &sc)
+    case JetStreamBroker:
+        return NewJetStreamConsumer(ctx, errch, &conf.JetStreamConf)
+    }
+    return nil, fmt.Errorf("NewSubscriber | Unknown broker: %s", conf.Broker)
+}
+
+// stan client id allows only letters, digits, '-' and '_'
+func clientIdPart(s string) string {
+    return strings.Map(func(r rune) rune {
+        switch {
+        case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+            return r
+        }
+        return '_'
+    }, s)
+}
+
+// durable name used for checkpoints, empty - no checkpoints.
+// Queue group members see different subsets of sequences,
+// so server side durable queue is the only resume point.
+func CheckpointName(conf *config.AppConfig) string {
+    if conf.Broker == JetStreamBroker {
+        return conf.JetStreamConf.DurableName
+    }
+    if conf.StanConf.QueueGroup != "" {
+        return ""
     }
+    return conf.StanConf.DurableName
 }
@@ -1,5 +1,24 @@
 package services
 
+import (
+    "fmt"
+    "errors"
+    "context"
+    "io"
+    "net"
+
+    "github.com/jackc/pgx/v5"
+    "github.com/jackc/pgx/v5/pgconn"
+)
+
+var (
+    OrderNotFound = errors.New("Order not found")
+    OrderDuplicate = errors.New("Order already stored with same payload")
+    OrderConflict = errors.New("Order already stored with different payload")
+    OrderVersioned = errors.New("Order conflicting payload archived as new version")
+    CacheLoadTimeout = errors.New("Order load from storage is not finished in time")
+)
+
 type DBConnectionLost struct {
     msg string
     err error
@@ -13,3 +32,114 @@ func (e *DBConnectionLost) Unwrap() error {
     return (*e).err
 }
 
+// db didn`t answer in configured timeout
+type DBTimeout struct {
+    msg string
+    err error
+}
+
+func (e *DBTimeout) Error() string {
+    return (*e).msg
+}
+
+func (e *DBTimeout) Unwrap() error {
+    return (*e).err
+}
+
+// db answers, but request can`t succeed
+// without operator: schema, permissions, auth
+type DBFatal struct {
+    msg string
+    err error
+}
+
+func (e *DBFatal) Error() string {
+    return (*e).msg
+}
+
+func (e *DBFatal) Unwrap() error {
+    return (*e).err
+}
+
+// broker connection or subscription lost
+type ConsumerDisconnected struct {
+    msg string
+    err error
+}
+
+func (e *ConsumerDisconnected) Error() string {
+    return (*e).msg
+}
+
+func (e *ConsumerDisconnected) Unwrap() error {
+    return (*e).err
+}
+
+func NewConsumerDisconnected(mark string, err error) *ConsumerDisconnected {
+    return &ConsumerDisconnected{
+        msg: fmt.Sprintf("%s | Consumer disconnected: %s", mark, err.Error()),
+        err: err,
+    }
+}
+
+// 42 - syntax error or undefined object, 28 - auth,
+// 3D / 3F - invalid catalog or schema
+func isFatalDBError(err error) bool {
+    var pgErr *pgconn.PgError
+    if !errors.As(err, &pgErr) {
+        return false
+    }
+    switch (*pgErr).Code[:2] {
+    case "42", "28", "3D", "3F":
+        return true
+    }
+    return false
+}
+
+// connection was broken or can`t be established
+func isConnectionError(err error) bool {
+    var netErr net.Error
+    var pgErr *pgconn.PgError
+    if errors.As(err, &netErr) {
+        return true
+    }
+    if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+        return true
+    }
+    // class 08 - connection exception, 57P0x - server shutdown
+    if errors.As(err, &pgErr) {
+        code := (*pgErr).Code
+        return code[:2] == "08" || code[:4] == "57P0"
+    }
+    return false
+}
+
+func isUniqueViolation(err error) bool {
+    var pgErr *pgconn.PgError
+    return errors.As(err, &pgErr) && (*pgErr).Code == "23505"
+}
+
+// wrap db error into one of typed app errors.
+// Unknown errors are wrapped as is.
+func classifyDBError(mark string, err error) error {
+    switch {
+    case errors.Is(err, pgx.ErrNoRows):
+        return fmt.Errorf("%s | %w", mark, OrderNotFound)
+    case errors.Is(err, context.DeadlineExceeded) || pgconn.Timeout(err):
+        return &DBTimeout{
+            msg: fmt.Sprintf("%s | DB timeout: %s", mark, err.Error()),
+            err: err,
+        }
+    case isFatalDBError(err):
+        return &DBFatal{
+            msg: fmt.Sprintf("%s | DB fatal error: %s", mark, err.Error()),
+            err: err,
+        }
+    case isConnectionError(err):
+        return &DBConnectionLost{
+            msg: fmt.Sprintf("%s | DB connection lost: %s", mark, err.Error()),
+            err: err,
+        }
+    }
+    return fmt.Errorf("%s | Error %w", mark, err)
+}
@@ -0,0 +1,106 @@
+package services
+
+import (
+    "sync"
+    "time"
+)
+
+type BreakerState uint8
+
+const (
+    BreakerClosed BreakerState = iota
+    BreakerOpen
+    // one probe request is allowed
+    BreakerHalfOpen
+)
+
+func (bs BreakerState) String() string {
+    switch bs {
+    case BreakerOpen:
+        return "open"
+    case BreakerHalfOpen:
+        return "half_open"
+    }
+    return "closed"
+}
+
+// circuit breaker: opens after threshold failures in a row,
+// after openTime lets one request through to check backend
+type Breaker struct {
+    mu sync.Mutex
+    state BreakerState
+    failures int
+    threshold int
+    openTime time.Duration
+    openedAt time.Time
+    // called on state change, outside of lock
+    onChange func(from, to BreakerState)
+}
+
+func NewBreaker(threshold int, openTime time.Duration) *Breaker {
+    if threshold <= 0 {
+        threshold = 1
+    }
+    return &Breaker{threshold: threshold, openTime: openTime}
+}
+
+func (b *Breaker) OnChange(fn func(from, to BreakerState)) *Breaker {
+    (*b).onChange = fn
+    return b
+}
+
+// false means request must not reach backend
+func (b *Breaker) Allow() bool {
+    (*b).mu.Lock()
+    from := (*b).state
+    switch from {
+    case BreakerClosed:
+        (*b).mu.Unlock()
+        return true
+    case BreakerOpen:
+        if time.Since((*b).openedAt) < (*b).openTime {
+            (*b).mu.Unlock()
+            return false
+        }
+        (*b).state = BreakerHalfOpen
+        (*b).mu.Unlock()
+        (*b).changed(from, BreakerHalfOpen)
+        return true
+    }
+    // probe is in flight
+    (*b).mu.Unlock()
+    return false
+}
+
+// report request result, nil means success
+func (b *Breaker) Done(err error) {
+    (*b).mu.Lock()
+    from := (*b).state
+    if err == nil {
+        (*b).failures = 0
+        (*b).state = BreakerClosed
+    } else {
+        (*b).failures++
+        if from == BreakerHalfOpen || (*b).failures >= (*b).threshold {
+            (*b).state = BreakerOpen
+            (*b).openedAt = time.Now()
+        }
+    }
+    to := (*b).state
+    (*b).mu.Unlock()
+    if from != to {
+        (*b).changed(from, to)
+    }
+}
+
+func (b *Breaker) State() BreakerState {
+    (*b).mu.Lock()
+    defer (*b).mu.Unlock()
+    return (*b).state
+}
+
+func (b *Breaker) changed(from, to BreakerState) {
+    if (*b).onChange != nil {
+        (*b).onChange(from, to)
+    }
+}
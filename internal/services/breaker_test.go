@@ -0,0 +1,111 @@
+package services
+
+import (
+    "errors"
+    "testing"
+    "time"
+)
+
+func TestBreaker(t *testing.T) {
+    fail := errors.New("down")
+    type step struct {
+        // sleep before step, lets open time pass
+        wait bool
+        allow bool
+        // reported result when allowed
+        err error
+        state BreakerState
+    }
+    cases := []struct {
+        name string
+        threshold int
+        steps []step
+    }{
+        {
+            name: "closed on success",
+            threshold: 2,
+            steps: []step{
+                {allow: true, state: BreakerClosed},
+                {allow: true, err: fail, state: BreakerClosed},
+                // success resets failures
+                {allow: true, state: BreakerClosed},
+                {allow: true, err: fail, state: BreakerClosed},
+            },
+        },
+        {
+            name: "opens after threshold",
+            threshold: 2,
+            steps: []step{
+                {allow: true, err: fail, state: BreakerClosed},
+                {allow: true, err: fail, state: BreakerOpen},
+                {allow: false, state: BreakerOpen},
+            },
+        },
+        {
+            name: "half open probe closes",
+            threshold: 1,
+            steps: []step{
+                {allow: true, err: fail, state: BreakerOpen},
+                {wait: true, allow: true, state: BreakerClosed},
+                {allow: true, state: BreakerClosed},
+            },
+        },
+        {
+            name: "half open probe fails",
+            threshold: 3,
+            steps: []step{
+                {allow: true, err: fail, state: BreakerClosed},
+                {allow: true, err: fail, state: BreakerClosed},
+                {allow: true, err: fail, state: BreakerOpen},
+                // one failed probe is enough to open again
+                {wait: true, allow: true, err: fail, state: BreakerOpen},
+                {allow: false, state: BreakerOpen},
+            },
+        },
+    }
+    openTime := 20 * time.Millisecond
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            b := NewBreaker(tc.threshold, openTime)
+            for i, st := range tc.steps {
+                if st.wait {
+                    time.Sleep(openTime + 5 * time.Millisecond)
+                }
+                if got := b.Allow(); got != st.allow {
+                    t.Fatalf("step %d: Allow = %v, want %v", i, got, st.allow)
+                }
+                if st.allow {
+                    b.Done(st.err)
+                }
+                if got := b.State(); got != st.state {
+                    t.Fatalf("step %d: state %s, want %s", i, got, st.state)
+                }
+            }
+        })
+    }
+}
+
+func TestBreakerSingleProbe(t *testing.T) {
+    b := NewBreaker(1, time.Millisecond)
+    var changes []BreakerState
+    b.OnChange(func(from, to BreakerState) {changes = append(changes, to)})
+    b.Allow()
+    b.Done(errors.New("down"))
+    time.Sleep(2 * time.Millisecond)
+    if !b.Allow() {
+        t.Fatal("probe is not allowed")
+    }
+    if b.Allow() {
+        t.Fatal("second request allowed while probe is in flight")
+    }
+    b.Done(nil)
+    want := []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerClosed}
+    if len(changes) != len(want) {
+        t.Fatalf("changes %v, want %v", changes, want)
+    }
+    for i := range want {
+        if changes[i] != want[i] {
+            t.Fatalf("changes %v, want %v", changes, want)
+        }
+    }
+}
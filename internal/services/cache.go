@@ -8,6 +8,14 @@ import (
     "github.com/bluele/gcache"
 
     "nats_app/internal/config"
+    "nats_app/internal/metrics"
+)
+
+const (
+    // eviction policies supported by gcache
+    PolicyLRU string = "lru"
+    PolicyLFU string = "lfu"
+    PolicyARC string = "arc"
 )
 
 var (
@@ -16,91 +24,235 @@ var (
 
 // base cache interface
 type MemCache interface {
-    Get(key string) (interface{}, error)
+    Get(key string) (Order, error)
     Set(key string, val interface{}) (bool, error)
     Setex(key string, val interface{}, exp time.Duration) (bool, error)
-    // callback when item evicked from cache
-    OnEvict(func(interface{}, interface{})) MemCache
-    // callback when item added to cache
-    OnAdd(func(string, interface{})) MemCache
-    OnLoad(func(string) interface{}) MemCache
-    Build() MemCache
+    // fetch item from source on miss, doesn`t cache it
+    Load(key string) (Order, error)
+    // default expiration for items
+    TTL() time.Duration
+    Has(key string) bool
+    // items from least to most recently used
+    Entries() []CacheEntry
+    Stats() CacheStats
+    Usage() (int64, int)
 }
 
-// gcache item wrapper
-type AppLRUCache struct {
+// cached item with expiration, used for snapshots
+type CacheEntry struct {
+    Key string
+    Payload *[]byte
+    // zero - no expiration
+    Expires time.Time
+}
+
+var _ MemCache = (*AppMemCache)(nil)
+
+// gcache item wrapper, eviction policy is set from config.
+// Byte pressure evicts items by the same policy.
+type AppMemCache struct {
     c *gcache.Cache
     ExpT time.Duration
     Size int
-    On_load func(string) Order
+    Policy string
+    // payload bytes limits, 0 - no limit
+    MaxBytes int64
+    MaxEntryBytes int64
+    mem *memAccount
+    On_load func(string) (Order, error)
     on_evict func(string, *[]byte)
     on_add func(string, *[]byte)
 }
 
-func (ac *AppLRUCache) Get(key string) (Order, error) {
+func (ac *AppMemCache) Get(key string) (Order, error) {
     var val interface{}
     var err error
     if val, err = (*ac.c).Get(key); err != nil {
         return Order{}, fmt.Errorf("%w", err)
     }
+    (*ac).mem.touch(key)
     return Order{key, val.(*[]byte)}, nil
 }
 
-func (ac *AppLRUCache) Set(key string, val interface{}) (bool, error) {
-    mark := "AppLRUCache.Set"
+// payload size for accounting, only raw bytes are expected
+func payloadSize(val interface{}) int64 {
+    switch v := val.(type) {
+    case *[]byte:
+        if v == nil {
+            return 0
+        }
+        return int64(len(*v))
+    case []byte:
+        return int64(len(v))
+    }
+    return 0
+}
+
+// payload is too large to be cached
+func (ac *AppMemCache) oversized(val interface{}) bool {
+    if (*ac).MaxEntryBytes <= 0 || payloadSize(val) <= (*ac).MaxEntryBytes {
+        return false
+    }
+    metrics.CacheOversized.Inc()
+    return true
+}
+
+// evict items until payload bytes fit into limit
+func (ac *AppMemCache) shrink() {
+    if (*ac).MaxBytes <= 0 {
+        return
+    }
+    for {
+        key, ok := (*ac).mem.victim((*ac).MaxBytes)
+        if !ok {
+            return
+        }
+        if !(*ac.c).Remove(key) {
+            // already gone from cache
+            (*ac).mem.remove(key)
+        }
+    }
+}
+
+func (ac *AppMemCache) Has(key string) bool {
+    return (*ac.c).Has(key)
+}
+
+// not expired items from least to most recently used,
+// cache order is not changed
+func (ac *AppMemCache) Entries() []CacheEntry {
+    items := (*ac.c).GetALL(true)
+    ordered := (*ac).mem.ordered()
+    entries := make([]CacheEntry, 0, len(ordered))
+    for _, ent := range ordered {
+        payload, ok := items[ent.key].(*[]byte)
+        if !ok || payload == nil {
+            continue
+        }
+        entries = append(entries, CacheEntry{ent.key, payload, ent.expires})
+    }
+    return entries
+}
+
+// payload bytes and entries
+func (ac *AppMemCache) Usage() (int64, int) {
+    return (*ac).mem.usage()
+}
+
+// payload bytes, entries and largest items
+func (ac *AppMemCache) Stats() CacheStats {
+    st := (*ac).mem.stats(largestItemsTop)
+    st.MaxBytes = (*ac).MaxBytes
+    st.MaxEntryBytes = (*ac).MaxEntryBytes
+    return st
+}
+
+func (ac *AppMemCache) Set(key string, val interface{}) (bool, error) {
+    mark := "AppMemCache.Set"
     if key == "" {
         return false, EmptyCacheKey
     }
+    if (*ac).oversized(val) {
+        return false, nil
+    }
     err := (*ac.c).Set(key, val)
     if err != nil {
         return false, fmt.Errorf("%s error %w", mark, err)
     }
+    (*ac).shrink()
     return true, nil
 }
 
-func (ac *AppLRUCache) Setex(key string, val interface{}, exp time.Duration) (bool, error) {
-    mark := "AppLRUCache.Setex"
+func (ac *AppMemCache) Setex(key string, val interface{}, exp time.Duration) (bool, error) {
+    mark := "AppMemCache.Setex"
     if key == "" {
         return false, EmptyCacheKey
     }
+    if (*ac).oversized(val) {
+        return false, nil
+    }
     err := (*ac.c).SetWithExpire(key, val, exp)
     if err != nil {
         return false, fmt.Errorf("%s error %w", mark, err)
     }
+    (*ac).mem.expire(key, time.Now().Add(exp))
+    (*ac).shrink()
     return true, nil
 }
 
-func (ac *AppLRUCache) OnEvict(evict func(string, *[]byte)) *AppLRUCache {
+func (ac *AppMemCache) OnEvict(evict func(string, *[]byte)) *AppMemCache {
     (*ac).on_evict = evict
     return ac
 }
 
-func (ac *AppLRUCache) OnAdd(add func(string, *[]byte)) *AppLRUCache {
+func (ac *AppMemCache) OnAdd(add func(string, *[]byte)) *AppMemCache {
     (*ac).on_add = add
     return ac
 }
 
+func (ac *AppMemCache) Load(key string) (Order, error) {
+    if (*ac).On_load == nil {
+        return Order{}, fmt.Errorf("AppMemCache.Load | No loader for key %s", key)
+    }
+    return (*ac).On_load(key)
+}
+
+func (ac *AppMemCache) TTL() time.Duration {
+    return (*ac).ExpT
+}
+
 // set handler for automatically data fetching from DB.
-func (ac *AppLRUCache) OnLoad(loader func(string) Order) *AppLRUCache {
+func (ac *AppMemCache) OnLoad(loader func(string) (Order, error)) *AppMemCache {
     (*ac).On_load = loader
     return ac
 }
 
-func (ac *AppLRUCache) Build() *AppLRUCache {
-    c := gcache.New((*ac).Size).
-        LRU().
+func (ac *AppMemCache) Build() (*AppMemCache, error) {
+    size := (*ac).Size
+    if size <= 0 && (*ac).MaxBytes > 0 {
+        // bounded by bytes, entries limit just keeps gcache sane
+        size = defaultMaxEntries
+    }
+    builder := gcache.New(size)
+    (*ac).mem.policy = (*ac).Policy
+    switch (*ac).Policy {
+    case PolicyLRU, "":
+        (*ac).mem.policy = PolicyLRU
+        builder = builder.LRU()
+    case PolicyLFU:
+        builder = builder.LFU()
+    case PolicyARC:
+        builder = builder.ARC()
+    default:
+        return nil, fmt.Errorf("AppMemCache.Build | Unknown eviction policy: %s", (*ac).Policy)
+    }
+    c := builder.
         EvictedFunc(func(key, value interface{}) {
-            (*ac).on_evict(key.(string), value.(*[]byte))
+            metrics.CacheEvictions.Inc()
+            (*ac).mem.remove(key.(string))
+            if (*ac).on_evict != nil {
+                (*ac).on_evict(key.(string), value.(*[]byte))
+            }
         }).
         AddedFunc(func(key, value interface{}) {
-            (*ac).on_add(key.(string), value.(*[]byte))
+            (*ac).mem.add(key.(string), payloadSize(value))
+            if (*ac).on_add != nil {
+                (*ac).on_add(key.(string), value.(*[]byte))
+            }
         }).
         Build()
     (*ac).c = &c
-    return ac
+    return ac, nil
 }
 
-// create new LRU cache
-func NewLRUCache(conf *config.CacheConfig) *AppLRUCache {
-    return &AppLRUCache{Size: (*conf).Size, ExpT: (*conf).Exp_time}
+// create new cache, call Build after callbacks setup
+func NewMemCache(conf *config.CacheConfig) *AppMemCache {
+    return &AppMemCache{
+        Size: (*conf).Size,
+        Policy: (*conf).Policy,
+        ExpT: (*conf).Exp_time,
+        MaxBytes: (*conf).MaxBytes,
+        MaxEntryBytes: (*conf).MaxEntryBytes,
+        mem: newMemAccount(),
+    }
 }
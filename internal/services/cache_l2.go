@@ -0,0 +1,130 @@
+package services
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "time"
+
+    "github.com/redis/go-redis/v9"
+
+    "nats_app/internal/config"
+    "nats_app/internal/metrics"
+)
+
+var (
+    L2Miss = errors.New("Key not found in L2 cache")
+    L2Unavailable = errors.New("L2 cache is unavailable, circuit is open")
+)
+
+// second tier cache shared between instances,
+// speaks redis protocol. Failures open circuit breaker,
+// then lookups go straight to db.
+type RedisL2 struct {
+    client *redis.Client
+    prefix string
+    ttl time.Duration
+    timeout time.Duration
+    breaker *Breaker
+}
+
+func NewRedisL2(conf *config.L2Config) *RedisL2 {
+    l2 := &RedisL2{
+        client: redis.NewClient(&redis.Options{
+            Addr: (*conf).Addr,
+            Password: (*conf).Password,
+            DB: (*conf).DB,
+            // breaker decides about retries
+            MaxRetries: -1,
+        }),
+        prefix: (*conf).KeyPrefix,
+        ttl: (*conf).TTL,
+        timeout: (*conf).Timeout,
+        breaker: NewBreaker((*conf).FailureThreshold, (*conf).OpenTime),
+    }
+    (*l2).breaker.OnChange(func(from, to BreakerState) {
+        metrics.CacheL2Breaker.Set(float64(to))
+    })
+    return l2
+}
+
+func (l2 *RedisL2) key(oid string) string {
+    return (*l2).prefix + oid
+}
+
+// run redis call under breaker with timeout
+func (l2 *RedisL2) do(parent context.Context, fn func(ctx context.Context) error) error {
+    if !(*l2).breaker.Allow() {
+        metrics.CacheL2Requests.WithLabelValues("skipped").Inc()
+        return L2Unavailable
+    }
+    ctx, cancel := context.WithTimeout(parent, (*l2).timeout)
+    defer cancel()
+    err := fn(ctx)
+    if errors.Is(err, redis.Nil) {
+        // backend answered
+        (*l2).breaker.Done(nil)
+        return L2Miss
+    }
+    (*l2).breaker.Done(err)
+    return err
+}
+
+func (l2 *RedisL2) Get(ctx context.Context, oid string) (Order, error) {
+    mark := "RedisL2.Get"
+    var payload []byte
+    err := (*l2).do(ctx, func(ctx context.Context) error {
+        var err error
+        payload, err = (*l2).client.Get(ctx, (*l2).key(oid)).Bytes()
+        return err
+    })
+    switch {
+    case err == nil:
+        metrics.CacheL2Requests.WithLabelValues("hit").Inc()
+        return Order{oid, &payload}, nil
+    case errors.Is(err, L2Miss):
+        metrics.CacheL2Requests.WithLabelValues("miss").Inc()
+        return Order{}, err
+    case errors.Is(err, L2Unavailable):
+        return Order{}, err
+    }
+    metrics.CacheL2Requests.WithLabelValues("error").Inc()
+    return Order{}, fmt.Errorf("%s | Error %w", mark, err)
+}
+
+// write orders in one pipeline
+func (l2 *RedisL2) Set(ctx context.Context, orders ...Order) error {
+    mark := "RedisL2.Set"
+    if len(orders) == 0 {
+        return nil
+    }
+    err := (*l2).do(ctx, func(ctx context.Context) error {
+        _, err := (*l2).client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+            for _, ord := range orders {
+                if ord.Payload == nil {
+                    continue
+                }
+                pipe.Set(ctx, (*l2).key(ord.Oid), *ord.Payload, (*l2).ttl)
+            }
+            return nil
+        })
+        return err
+    })
+    switch {
+    case err == nil:
+        metrics.CacheL2Requests.WithLabelValues("set").Inc()
+        return nil
+    case errors.Is(err, L2Unavailable):
+        return err
+    }
+    metrics.CacheL2Requests.WithLabelValues("error").Inc()
+    return fmt.Errorf("%s | Error %w", mark, err)
+}
+
+func (l2 *RedisL2) State() BreakerState {
+    return (*l2).breaker.State()
+}
+
+func (l2 *RedisL2) Close() error {
+    return (*l2).client.Close()
+}
@@ -0,0 +1,133 @@
+package services
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "time"
+
+    "github.com/alicebob/miniredis/v2"
+
+    "nats_app/internal/config"
+)
+
+func newTestL2(t *testing.T, threshold int, openTime time.Duration) (*RedisL2, *miniredis.Miniredis) {
+    t.Helper()
+    mr := miniredis.RunT(t)
+    l2 := NewRedisL2(&config.L2Config{
+        Addr: mr.Addr(),
+        KeyPrefix: "test:",
+        TTL: time.Minute,
+        Timeout: time.Second,
+        FailureThreshold: threshold,
+        OpenTime: openTime,
+    })
+    t.Cleanup(func() {l2.Close()})
+    return l2, mr
+}
+
+func testOrder(oid string, payload string) Order {
+    raw := []byte(payload)
+    return Order{oid, &raw}
+}
+
+func TestRedisL2GetSet(t *testing.T) {
+    l2, mr := newTestL2(t, 3, time.Second)
+    ctx := context.Background()
+    if _, err := l2.Get(ctx, "a"); !errors.Is(err, L2Miss) {
+        t.Fatalf("want L2Miss, got %v", err)
+    }
+    err := l2.Set(ctx, testOrder("a", `{"a":1}`), testOrder("b", `{"b":2}`), Order{Oid: "empty"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    got, err := l2.Get(ctx, "b")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got.Oid != "b" || string(*got.Payload) != `{"b":2}` {
+        t.Fatalf("got %s %s", got.Oid, *got.Payload)
+    }
+    // keys are prefixed, nil payload is skipped
+    if !mr.Exists("test:a") || mr.Exists("test:empty") {
+        t.Fatalf("stored keys %v", mr.Keys())
+    }
+    if l2.State() != BreakerClosed {
+        t.Fatalf("breaker %s after misses", l2.State())
+    }
+}
+
+func TestRedisL2TTL(t *testing.T) {
+    l2, mr := newTestL2(t, 3, time.Second)
+    ctx := context.Background()
+    if err := l2.Set(ctx, testOrder("a", `{}`)); err != nil {
+        t.Fatal(err)
+    }
+    if ttl := mr.TTL("test:a"); ttl != time.Minute {
+        t.Fatalf("ttl %s, want 1m", ttl)
+    }
+    mr.FastForward(time.Minute)
+    if _, err := l2.Get(ctx, "a"); !errors.Is(err, L2Miss) {
+        t.Fatalf("expired key: want L2Miss, got %v", err)
+    }
+}
+
+func TestRedisL2Breaker(t *testing.T) {
+    openTime := 50 * time.Millisecond
+    l2, mr := newTestL2(t, 2, openTime)
+    ctx := context.Background()
+    l2.Set(ctx, testOrder("a", `{}`))
+
+    mr.SetError("LOADING server is loading")
+    for i := 0; i < 2; i++ {
+        if _, err := l2.Get(ctx, "a"); err == nil || errors.Is(err, L2Unavailable) {
+            t.Fatalf("request %d: want backend error, got %v", i, err)
+        }
+    }
+    if l2.State() != BreakerOpen {
+        t.Fatalf("breaker %s, want open", l2.State())
+    }
+    if err := l2.Set(ctx, testOrder("b", `{}`)); !errors.Is(err, L2Unavailable) {
+        t.Fatalf("open circuit: want L2Unavailable, got %v", err)
+    }
+
+    // failed probe opens circuit again
+    time.Sleep(openTime + 10 * time.Millisecond)
+    if _, err := l2.Get(ctx, "a"); err == nil || errors.Is(err, L2Unavailable) {
+        t.Fatalf("probe: want backend error, got %v", err)
+    }
+    if l2.State() != BreakerOpen {
+        t.Fatalf("breaker %s after failed probe, want open", l2.State())
+    }
+
+    // backend is back, probe closes circuit
+    mr.SetError("")
+    time.Sleep(openTime + 10 * time.Millisecond)
+    if _, err := l2.Get(ctx, "a"); err != nil {
+        t.Fatalf("probe: %v", err)
+    }
+    if l2.State() != BreakerClosed {
+        t.Fatalf("breaker %s after probe, want closed", l2.State())
+    }
+}
+
+// ingestion must not wait for L2
+func TestPopulateL2Async(t *testing.T) {
+    l2, mr := newTestL2(t, 3, time.Second)
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    ca := AppCache{ctx: &ctx, log: discardLog}
+    ca.SetL2(l2)
+    for i := 0; i < l2QueueSize + 10; i++ {
+        // writer is not running, extra writes are dropped
+        ca.populateL2(testOrder("a", `{}`))
+    }
+    go ca.writeL2()
+    deadline := time.Now().Add(time.Second)
+    for !mr.Exists("test:a") {
+        if time.Now().After(deadline) {
+            t.Fatal("queued order is not written")
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+}
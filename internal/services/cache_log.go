@@ -0,0 +1,246 @@
+package services
+
+import (
+    "container/list"
+    "context"
+    "errors"
+    "fmt"
+    "log/slog"
+    "sync"
+
+    "nats_app/internal/metrics"
+)
+
+const (
+    // log overflow policies, writers wait in Admit
+    // (outside of cache lock), log itself never blocks.
+    // wait for next sync
+    LogOverflowBlock string = "block"
+    // forget oldest pending key
+    LogOverflowDropOldest string = "drop_oldest"
+    // ask for sync now and wait for it
+    LogOverflowFlush string = "flush"
+    defaultLogLimit int = 2048
+)
+
+var (
+    CacheLogOverflow = errors.New("Cache log overflow")
+)
+
+type ConcurrentLog interface {
+    Dump(ctx *context.Context, in chan<- LogMessage, l *slog.Logger) []CacheLogMessage
+    Requeue(records []CacheLogMessage)
+    LogEvicted(key string) error
+    LogAdded(key string) error
+    Pending() int
+}
+
+var _ ConcurrentLog = (*CacheLog)(nil)
+
+type LogMessage interface {
+    OpCode() uint8
+    Payload() string
+}
+
+type CacheLogMessage struct {
+    // operation: evict or add
+    op uint8
+    // key to fing record in DB
+    key string
+}
+
+func (clm CacheLogMessage) OpCode() uint8 {
+    return clm.op
+}
+
+func (clm CacheLogMessage) Payload() string {
+    return clm.key
+}
+
+// write-behind log of cache state changes.
+// Ops on same key are coalesced into the last one,
+// number of pending keys is bounded by limit.
+type CacheLog struct {
+    lock sync.Mutex
+    // pending keys from oldest to newest, values are *CacheLogMessage
+    order *list.List
+    keys map[string]*list.Element
+    limit int
+    overflow string
+    // closed and replaced when log is dumped
+    space chan struct{}
+    // early sync requests, buffered for one
+    flush chan struct{}
+    done <-chan struct{}
+}
+
+// called from cache callbacks under cache lock, must not wait.
+// Block and flush policies keep record over limit, writers
+// are held back by Admit. CacheLogOverflow - oldest key was dropped.
+func (el *CacheLog) log(op uint8, key string) error {
+    (*el).lock.Lock()
+    defer (*el).lock.Unlock()
+    if e, ok := (*el).keys[key]; ok {
+        // only final state goes to db
+        e.Value.(*CacheLogMessage).op = op
+        (*el).order.MoveToBack(e)
+        return nil
+    }
+    var err error
+    if (*el).limit > 0 && (*el).order.Len() >= (*el).limit {
+        metrics.CacheLogOverflow.Inc()
+        switch (*el).overflow {
+        case LogOverflowDropOldest:
+            oldest := (*el).order.Front()
+            delete((*el).keys, oldest.Value.(*CacheLogMessage).key)
+            (*el).order.Remove(oldest)
+            err = CacheLogOverflow
+        case LogOverflowFlush:
+            (*el).requestFlush()
+        }
+    }
+    (*el).keys[key] = (*el).order.PushBack(&CacheLogMessage{op, key})
+    return err
+}
+
+// wait until log has room for new keys, call before cache Set.
+// drop_oldest never waits, CacheLogOverflow if done is closed.
+func (el *CacheLog) Admit() error {
+    (*el).lock.Lock()
+    for (*el).full() {
+        if (*el).overflow == LogOverflowFlush {
+            (*el).requestFlush()
+        }
+        // wait for dump
+        space := (*el).space
+        (*el).lock.Unlock()
+        select {
+        case <-space:
+        case <-(*el).done:
+            return CacheLogOverflow
+        }
+        (*el).lock.Lock()
+    }
+    (*el).lock.Unlock()
+    return nil
+}
+
+// must be called under lock
+func (el *CacheLog) full() bool {
+    if (*el).limit <= 0 || (*el).overflow == LogOverflowDropOldest {
+        return false
+    }
+    return (*el).order.Len() >= (*el).limit
+}
+
+func (el *CacheLog) requestFlush() {
+    select {
+    case (*el).flush<- struct{}{}:
+    default:
+        // already requested
+    }
+}
+
+// early sync requests on overflow
+func (el *CacheLog) FlushRequests() <-chan struct{} {
+    return (*el).flush
+}
+
+// take all pending records and send them into <in>,
+// channel is closed on every path. Not sent records are put
+// back on cancel, sent ones are returned: caller requeues them
+// if they were not committed.
+func (el *CacheLog) Dump(ctx *context.Context, in chan<- LogMessage, l *slog.Logger) []CacheLogMessage {
+    mark := "CacheLog.Dump"
+    defer close(in)
+    (*el).lock.Lock()
+    records := make([]CacheLogMessage, 0, (*el).order.Len())
+    for e := (*el).order.Front(); e != nil; e = e.Next() {
+        records = append(records, *e.Value.(*CacheLogMessage))
+    }
+    (*el).order.Init()
+    (*el).keys = make(map[string]*list.Element)
+    // wake up writers
+    close((*el).space)
+    (*el).space = make(chan struct{})
+    (*el).lock.Unlock()
+
+    l.Debug(fmt.Sprintf("%s | Run dump... | %d", mark, len(records)))
+    if len(records) == 0 {
+        select {
+        case in<- CacheLogMessage{EmptyLog, ""}:
+        case <-(*ctx).Done():
+            l.Debug(fmt.Sprintf("%s | Empty cache log...", mark))
+        }
+        return nil
+    }
+    for i, rec := range records {
+        select {
+        case in<- rec:
+        case <-(*ctx).Done():
+            l.Debug(fmt.Sprintf("%s | Cancelled, %d records back to log...", mark, len(records) - i))
+            (*el).requeue(records[i:])
+            return records[:i]
+        }
+    }
+    l.Debug(fmt.Sprintf("%s | Dumped %d records...", mark, len(records)))
+    return records
+}
+
+// put back dumped records that were not committed,
+// newer ops on same key win
+func (el *CacheLog) Requeue(records []CacheLogMessage) {
+    (*el).requeue(records)
+}
+
+// return not sent records, newer ops on same key win
+func (el *CacheLog) requeue(records []CacheLogMessage) {
+    (*el).lock.Lock()
+    defer (*el).lock.Unlock()
+    for i := len(records) - 1; i >= 0; i-- {
+        rec := records[i]
+        if _, ok := (*el).keys[rec.key]; ok {
+            continue
+        }
+        if (*el).limit > 0 && (*el).order.Len() >= (*el).limit {
+            metrics.CacheLogOverflow.Inc()
+            return
+        }
+        (*el).keys[rec.key] = (*el).order.PushFront(&rec)
+    }
+}
+
+func (el *CacheLog) LogEvicted(key string) error {
+    return (*el).log(Evicted, key)
+}
+
+func (el *CacheLog) LogAdded(key string) error {
+    return (*el).log(Added, key)
+}
+
+// keys waiting for sync with db
+func (el *CacheLog) Pending() int {
+    (*el).lock.Lock()
+    defer (*el).lock.Unlock()
+    return (*el).order.Len()
+}
+
+// writers waiting in Admit are released when done is closed
+func NewCacheLog(limit int, overflow string, done <-chan struct{}) (*CacheLog, error) {
+    switch overflow {
+    case LogOverflowBlock, LogOverflowDropOldest, LogOverflowFlush:
+    case "":
+        overflow = LogOverflowFlush
+    default:
+        return nil, fmt.Errorf("NewCacheLog | Unknown overflow policy: %s", overflow)
+    }
+    return &CacheLog{
+        order: list.New(),
+        keys: make(map[string]*list.Element),
+        limit: limit,
+        overflow: overflow,
+        space: make(chan struct{}),
+        flush: make(chan struct{}, 1),
+        done: done,
+    }, nil
+}
@@ -0,0 +1,234 @@
+package services
+
+import (
+    "context"
+    "errors"
+    "io"
+    "log/slog"
+    "testing"
+    "time"
+)
+
+var discardLog = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func dumpAll(t *testing.T, el *CacheLog) []CacheLogMessage {
+    t.Helper()
+    ctx := context.Background()
+    in := make(chan LogMessage)
+    go el.Dump(&ctx, in, discardLog)
+    var got []CacheLogMessage
+    for msg := range in {
+        if msg.OpCode() == EmptyLog {
+            continue
+        }
+        got = append(got, msg.(CacheLogMessage))
+    }
+    return got
+}
+
+func TestCacheLogCoalesce(t *testing.T) {
+    cases := []struct {
+        name string
+        ops []CacheLogMessage
+        want []CacheLogMessage
+    }{
+        {
+            name: "empty",
+        },
+        {
+            name: "last op wins",
+            ops: []CacheLogMessage{{Added, "a"}, {Evicted, "a"}, {Added, "a"}},
+            want: []CacheLogMessage{{Added, "a"}},
+        },
+        {
+            name: "updated key moves to end",
+            ops: []CacheLogMessage{{Added, "a"}, {Added, "b"}, {Evicted, "a"}},
+            want: []CacheLogMessage{{Added, "b"}, {Evicted, "a"}},
+        },
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            el, err := NewCacheLog(0, LogOverflowBlock, nil)
+            if err != nil {
+                t.Fatal(err)
+            }
+            for _, op := range tc.ops {
+                if err := el.log(op.op, op.key); err != nil {
+                    t.Fatalf("log %v: %v", op, err)
+                }
+            }
+            got := dumpAll(t, el)
+            if len(got) != len(tc.want) {
+                t.Fatalf("got %v, want %v", got, tc.want)
+            }
+            for i := range got {
+                if got[i] != tc.want[i] {
+                    t.Fatalf("got %v, want %v", got, tc.want)
+                }
+            }
+            if el.Pending() != 0 {
+                t.Fatalf("pending after dump: %d", el.Pending())
+            }
+        })
+    }
+}
+
+func TestCacheLogDropOldest(t *testing.T) {
+    el, _ := NewCacheLog(2, LogOverflowDropOldest, nil)
+    el.LogAdded("a")
+    el.LogAdded("b")
+    if err := el.LogAdded("c"); !errors.Is(err, CacheLogOverflow) {
+        t.Fatalf("want CacheLogOverflow, got %v", err)
+    }
+    if err := el.Admit(); err != nil {
+        t.Fatalf("drop_oldest must not wait: %v", err)
+    }
+    got := dumpAll(t, el)
+    want := []CacheLogMessage{{Added, "b"}, {Added, "c"}}
+    if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+        t.Fatalf("got %v, want %v", got, want)
+    }
+}
+
+// log is called under cache lock and must never wait
+func TestCacheLogNeverBlocks(t *testing.T) {
+    for _, policy := range []string{LogOverflowBlock, LogOverflowFlush} {
+        t.Run(policy, func(t *testing.T) {
+            el, _ := NewCacheLog(1, policy, nil)
+            done := make(chan struct{})
+            go func() {
+                defer close(done)
+                for _, key := range []string{"a", "b", "c"} {
+                    if err := el.LogAdded(key); err != nil {
+                        t.Errorf("log %s: %v", key, err)
+                    }
+                }
+            }()
+            select {
+            case <-done:
+            case <-time.After(time.Second):
+                t.Fatal("log blocked on overflow")
+            }
+            if el.Pending() != 3 {
+                t.Fatalf("records over limit are kept, pending %d", el.Pending())
+            }
+        })
+    }
+}
+
+func TestCacheLogAdmit(t *testing.T) {
+    el, _ := NewCacheLog(1, LogOverflowFlush, nil)
+    el.LogAdded("a")
+    admitted := make(chan error)
+    go func() {admitted<- el.Admit()}()
+    select {
+    case <-el.FlushRequests():
+    case <-time.After(time.Second):
+        t.Fatal("flush is not requested")
+    }
+    select {
+    case err := <-admitted:
+        t.Fatalf("admitted before dump: %v", err)
+    case <-time.After(50 * time.Millisecond):
+    }
+    dumpAll(t, el)
+    select {
+    case err := <-admitted:
+        if err != nil {
+            t.Fatal(err)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("writer is not released by dump")
+    }
+}
+
+func TestCacheLogAdmitDone(t *testing.T) {
+    done := make(chan struct{})
+    el, _ := NewCacheLog(1, LogOverflowBlock, done)
+    el.LogAdded("a")
+    close(done)
+    if err := el.Admit(); !errors.Is(err, CacheLogOverflow) {
+        t.Fatalf("want CacheLogOverflow, got %v", err)
+    }
+}
+
+func TestCacheLogRequeue(t *testing.T) {
+    el, _ := NewCacheLog(0, LogOverflowBlock, nil)
+    el.LogAdded("a")
+    el.LogAdded("b")
+    ctx, cancel := context.WithCancel(context.Background())
+    in := make(chan LogMessage)
+    go el.Dump(&ctx, in, discardLog)
+    first := <-in
+    // newer op on not sent key
+    el.LogEvicted("b")
+    cancel()
+    for range in {
+    }
+    if first.Payload() != "a" {
+        t.Fatalf("first record %v", first)
+    }
+    got := dumpAll(t, el)
+    if len(got) != 1 || got[0] != (CacheLogMessage{Evicted, "b"}) {
+        t.Fatalf("got %v", got)
+    }
+}
+
+func TestNewCacheLogPolicy(t *testing.T) {
+    if _, err := NewCacheLog(1, "wait", nil); err == nil {
+        t.Fatal("unknown policy accepted")
+    }
+    el, err := NewCacheLog(1, "", nil)
+    if err != nil || el.overflow != LogOverflowFlush {
+        t.Fatalf("default policy: %v %v", el, err)
+    }
+}
+
+// records of failed transaction go back to log
+func TestCacheSyncRequeue(t *testing.T) {
+    cases := []struct {
+        name string
+        // read this many records, then report result
+        read int
+        committed bool
+        pending int
+    }{
+        {name: "committed", read: 3, committed: true, pending: 0},
+        {name: "commit failed", read: 3, committed: false, pending: 3},
+        {name: "begin failed", read: 0, committed: false, pending: 3},
+        {name: "failed midway", read: 1, committed: false, pending: 3},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            ctx := context.Background()
+            el, _ := NewCacheLog(0, LogOverflowBlock, nil)
+            for _, key := range []string{"a", "b", "c"} {
+                el.LogAdded(key)
+            }
+            ca := AppCache{ctx: &ctx, log: discardLog, evLog: el}
+            sync := ca.GetCacheSync(time.Second, func(ch <-chan LogMessage, cancel func()) bool {
+                defer cancel()
+                for i := 0; i < tc.read; i++ {
+                    <-ch
+                }
+                return tc.committed
+            })
+            select {
+            case <-sync():
+            case <-time.After(2 * time.Second):
+                t.Fatal("sync is not finished")
+            }
+            if el.Pending() != tc.pending {
+                t.Fatalf("pending %d, want %d", el.Pending(), tc.pending)
+            }
+            if tc.pending == 0 {
+                return
+            }
+            // original order is kept
+            got := dumpAll(t, el)
+            if got[0].key != "a" || got[2].key != "c" {
+                t.Fatalf("requeued %v", got)
+            }
+        })
+    }
+}
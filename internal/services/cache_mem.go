@@ -0,0 +1,212 @@
+package services
+
+import (
+    "container/list"
+    "sort"
+    "sync"
+    "time"
+)
+
+const (
+    // entries limit when cache is bounded by bytes only
+    defaultMaxEntries int = 1 << 16
+    // largest items in stats
+    largestItemsTop int = 10
+)
+
+type CacheEntrySize struct {
+    Key string `json:"key"`
+    Bytes int64 `json:"bytes"`
+}
+
+type CacheStats struct {
+    Entries int `json:"entries"`
+    Bytes int64 `json:"bytes"`
+    // 0 - not bounded by bytes
+    MaxBytes int64 `json:"max_bytes"`
+    MaxEntryBytes int64 `json:"max_entry_bytes"`
+    Largest []CacheEntrySize `json:"largest"`
+}
+
+type memEntry struct {
+    key string
+    size int64
+    // zero - no expiration
+    expires time.Time
+    // accesses, picks lfu / arc victims
+    freq int
+    // position in freqs bucket
+    fel *list.Element
+}
+
+// payload bytes accounting, updated from cache callbacks.
+// gcache doesn`t expose its eviction order, so access order
+// and frequencies are kept here to pick victims under byte
+// pressure by the same policy.
+type memAccount struct {
+    mu sync.Mutex
+    bytes int64
+    items map[string]*list.Element
+    // recency, front - most recently used
+    order *list.List
+    policy string
+    // entries by access count, front - most recently used
+    freqs map[int]*list.List
+    minFreq int
+}
+
+func newMemAccount() *memAccount {
+    return &memAccount{
+        items: make(map[string]*list.Element),
+        order: list.New(),
+        policy: PolicyLRU,
+        freqs: make(map[int]*list.List),
+    }
+}
+
+// must be called under lock
+func (ma *memAccount) unlinkFreq(ent *memEntry) {
+    bucket := (*ma).freqs[ent.freq]
+    bucket.Remove(ent.fel)
+    if bucket.Len() > 0 {
+        return
+    }
+    delete((*ma).freqs, ent.freq)
+    if ent.freq != (*ma).minFreq {
+        return
+    }
+    (*ma).minFreq = 0
+    for f := range (*ma).freqs {
+        if (*ma).minFreq == 0 || f < (*ma).minFreq {
+            (*ma).minFreq = f
+        }
+    }
+}
+
+// must be called under lock
+func (ma *memAccount) linkFreq(ent *memEntry) {
+    bucket, ok := (*ma).freqs[ent.freq]
+    if !ok {
+        bucket = list.New()
+        (*ma).freqs[ent.freq] = bucket
+    }
+    ent.fel = bucket.PushFront(ent)
+    if (*ma).minFreq == 0 || ent.freq < (*ma).minFreq {
+        (*ma).minFreq = ent.freq
+    }
+}
+
+// must be called under lock
+func (ma *memAccount) access(el *list.Element) {
+    ent := el.Value.(*memEntry)
+    (*ma).order.MoveToFront(el)
+    (*ma).unlinkFreq(ent)
+    ent.freq++
+    (*ma).linkFreq(ent)
+}
+
+// item added or replaced
+func (ma *memAccount) add(key string, size int64) {
+    (*ma).mu.Lock()
+    defer (*ma).mu.Unlock()
+    if el, ok := (*ma).items[key]; ok {
+        ent := el.Value.(*memEntry)
+        (*ma).bytes += size - ent.size
+        ent.size = size
+        (*ma).access(el)
+        return
+    }
+    (*ma).bytes += size
+    ent := &memEntry{key: key, size: size, freq: 1}
+    (*ma).items[key] = (*ma).order.PushFront(ent)
+    (*ma).linkFreq(ent)
+}
+
+func (ma *memAccount) expire(key string, at time.Time) {
+    (*ma).mu.Lock()
+    defer (*ma).mu.Unlock()
+    if el, ok := (*ma).items[key]; ok {
+        el.Value.(*memEntry).expires = at
+    }
+}
+
+// entries from least to most recently used
+func (ma *memAccount) ordered() []memEntry {
+    (*ma).mu.Lock()
+    defer (*ma).mu.Unlock()
+    entries := make([]memEntry, 0, (*ma).order.Len())
+    for el := (*ma).order.Back(); el != nil; el = el.Prev() {
+        entries = append(entries, *el.Value.(*memEntry))
+    }
+    return entries
+}
+
+func (ma *memAccount) remove(key string) {
+    (*ma).mu.Lock()
+    defer (*ma).mu.Unlock()
+    el, ok := (*ma).items[key]
+    if !ok {
+        return
+    }
+    ent := el.Value.(*memEntry)
+    (*ma).bytes -= ent.size
+    (*ma).order.Remove(el)
+    (*ma).unlinkFreq(ent)
+    delete((*ma).items, key)
+}
+
+func (ma *memAccount) touch(key string) {
+    (*ma).mu.Lock()
+    defer (*ma).mu.Unlock()
+    if el, ok := (*ma).items[key]; ok {
+        (*ma).access(el)
+    }
+}
+
+// key to evict while over limit, picked by eviction policy:
+// lru - least recently used, lfu - least frequently used
+// (ties by recency), arc - items seen once go first (ARC T1),
+// then least recently used. The only entry is never evicted.
+func (ma *memAccount) victim(limit int64) (string, bool) {
+    (*ma).mu.Lock()
+    defer (*ma).mu.Unlock()
+    if (*ma).bytes <= limit || (*ma).order.Len() < 2 {
+        return "", false
+    }
+    el := (*ma).order.Back()
+    switch (*ma).policy {
+    case PolicyLFU:
+        el = (*ma).freqs[(*ma).minFreq].Back()
+    case PolicyARC:
+        if once, ok := (*ma).freqs[1]; ok {
+            el = once.Back()
+        }
+    }
+    return el.Value.(*memEntry).key, true
+}
+
+// cheap version of stats for metrics
+func (ma *memAccount) usage() (int64, int) {
+    (*ma).mu.Lock()
+    defer (*ma).mu.Unlock()
+    return (*ma).bytes, len((*ma).items)
+}
+
+func (ma *memAccount) stats(top int) CacheStats {
+    (*ma).mu.Lock()
+    largest := make([]CacheEntrySize, 0, len((*ma).items))
+    for _, el := range (*ma).items {
+        ent := el.Value.(*memEntry)
+        largest = append(largest, CacheEntrySize{ent.key, ent.size})
+    }
+    st := CacheStats{Entries: len((*ma).items), Bytes: (*ma).bytes}
+    (*ma).mu.Unlock()
+    sort.Slice(largest, func(i, j int) bool {
+        return largest[i].Bytes > largest[j].Bytes
+    })
+    if len(largest) > top {
+        largest = largest[:top]
+    }
+    st.Largest = largest
+    return st
+}
@@ -0,0 +1,99 @@
+package services
+
+import (
+    "testing"
+)
+
+type memOp struct {
+    // add or touch
+    add bool
+    key string
+}
+
+func TestMemAccountVictim(t *testing.T) {
+    // a - added first and read twice, b - read once,
+    // c - never read, d - newest
+    ops := []memOp{
+        {true, "a"}, {true, "b"}, {true, "c"},
+        {false, "a"}, {false, "b"}, {false, "a"},
+        {true, "d"},
+    }
+    cases := []struct {
+        policy string
+        want []string
+    }{
+        // recency only: c, b, a, d
+        {PolicyLRU, []string{"c", "b", "a"}},
+        // fewest reads first, ties by recency
+        {PolicyLFU, []string{"c", "d", "b"}},
+        // seen once first, then recency
+        {PolicyARC, []string{"c", "d", "b"}},
+    }
+    for _, tc := range cases {
+        t.Run(tc.policy, func(t *testing.T) {
+            ma := newMemAccount()
+            ma.policy = tc.policy
+            for _, op := range ops {
+                if op.add {
+                    ma.add(op.key, 10)
+                } else {
+                    ma.touch(op.key)
+                }
+            }
+            for i, want := range tc.want {
+                key, ok := ma.victim(10)
+                if !ok || key != want {
+                    t.Fatalf("victim %d: %q %v, want %q", i, key, ok, want)
+                }
+                ma.remove(key)
+            }
+            // only entry is never evicted
+            if key, ok := ma.victim(0); ok {
+                t.Fatalf("last entry %q evicted", key)
+            }
+        })
+    }
+}
+
+func TestMemAccountUnderLimit(t *testing.T) {
+    ma := newMemAccount()
+    ma.add("a", 10)
+    ma.add("b", 10)
+    // replace keeps one entry per key
+    ma.add("a", 30)
+    if bytes, n := ma.usage(); bytes != 40 || n != 2 {
+        t.Fatalf("usage %d bytes, %d entries", bytes, n)
+    }
+    if key, ok := ma.victim(40); ok {
+        t.Fatalf("%q evicted under limit", key)
+    }
+    ma.remove("a")
+    ma.remove("missing")
+    if bytes, n := ma.usage(); bytes != 10 || n != 1 {
+        t.Fatalf("usage after remove %d bytes, %d entries", bytes, n)
+    }
+}
+
+func TestMemCacheByteLimit(t *testing.T) {
+    for _, policy := range []string{PolicyLRU, PolicyLFU, PolicyARC} {
+        t.Run(policy, func(t *testing.T) {
+            mc, err := (&AppMemCache{Size: 16, Policy: policy, MaxBytes: 25, mem: newMemAccount()}).Build()
+            if err != nil {
+                t.Fatal(err)
+            }
+            for _, key := range []string{"a", "b", "c"} {
+                payload := make([]byte, 10)
+                if _, err := mc.Set(key, &payload); err != nil {
+                    t.Fatal(err)
+                }
+            }
+            bytes, n := mc.Usage()
+            if bytes > 25 || n != 2 {
+                t.Fatalf("usage %d bytes, %d entries", bytes, n)
+            }
+            if !mc.Has("c") {
+                t.Fatal("newest key evicted")
+            }
+        })
+    }
+}
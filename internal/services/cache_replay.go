@@ -0,0 +1,97 @@
+package services
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "strconv"
+    "strings"
+
+    "nats_app/internal/config"
+)
+
+// one key access from recorded trace
+type TraceRecord struct {
+    Key string
+    // payload size, used on miss
+    Size int
+}
+
+type ReplayResult struct {
+    Policy string
+    Accesses int
+    Hits int
+    Misses int
+    Evictions int
+    Bytes int64
+    Entries int
+}
+
+func (rr ReplayResult) HitRatio() float64 {
+    if rr.Accesses == 0 {
+        return 0
+    }
+    return float64(rr.Hits) / float64(rr.Accesses)
+}
+
+// read trace: one access per line, "<key> [size]".
+// Empty lines and lines started with # are skipped.
+func ReadTrace(r io.Reader, defaultSize int) ([]TraceRecord, error) {
+    mark := "services.ReadTrace"
+    var trace []TraceRecord
+    scanner := bufio.NewScanner(r)
+    line := 0
+    for scanner.Scan() {
+        line++
+        fields := strings.Fields(scanner.Text())
+        if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+            continue
+        }
+        rec := TraceRecord{Key: fields[0], Size: defaultSize}
+        if len(fields) > 1 {
+            size, err := strconv.Atoi(fields[1])
+            if err != nil || size < 0 {
+                return nil, fmt.Errorf("%s | Invalid size at line %d: %s", mark, line, fields[1])
+            }
+            rec.Size = size
+        }
+        trace = append(trace, rec)
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, fmt.Errorf("%s | Error %w", mark, err)
+    }
+    return trace, nil
+}
+
+// replay trace against fresh cache with given policy,
+// missed keys are set as loaded from db
+func ReplayTrace(conf config.CacheConfig, trace []TraceRecord) (ReplayResult, error) {
+    res := ReplayResult{Policy: conf.Policy}
+    cache, err := NewMemCache(&conf).
+        OnEvict(func(string, *[]byte) {res.Evictions++}).
+        Build()
+    if err != nil {
+        return res, err
+    }
+    // payloads are shared, only size matters
+    payloads := make(map[int]*[]byte)
+    for _, rec := range trace {
+        res.Accesses++
+        if _, err := cache.Get(rec.Key); err == nil {
+            res.Hits++
+            continue
+        }
+        res.Misses++
+        payload, ok := payloads[rec.Size]
+        if !ok {
+            buf := make([]byte, rec.Size)
+            payload = &buf
+            payloads[rec.Size] = payload
+        }
+        if _, err := cache.Set(rec.Key, payload); err != nil {
+            return res, err
+        }
+    }
+    res.Bytes, res.Entries = cache.Usage()
+    return res, nil
+}
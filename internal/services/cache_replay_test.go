@@ -0,0 +1,110 @@
+package services
+
+import (
+    "fmt"
+    "math/rand"
+    "strings"
+    "testing"
+
+    "nats_app/internal/config"
+)
+
+// a, b, c fill cache of 3, a is read most,
+// then d, c, a, e, d, c compete for space
+const fixedTrace string = `# key size
+a 10
+b 10
+c 10
+a
+a
+b
+d 10
+c
+
+a
+e
+d
+c
+`
+
+func TestReadTrace(t *testing.T) {
+    trace, err := ReadTrace(strings.NewReader(fixedTrace), 7)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(trace) != 12 {
+        t.Fatalf("%d records, want 12", len(trace))
+    }
+    if trace[0] != (TraceRecord{Key: "a", Size: 10}) || trace[3] != (TraceRecord{Key: "a", Size: 7}) {
+        t.Fatalf("records %+v, %+v", trace[0], trace[3])
+    }
+    for _, bad := range []string{"a ten", "a -1"} {
+        if _, err = ReadTrace(strings.NewReader(bad), 0); err == nil {
+            t.Fatalf("trace %q accepted", bad)
+        }
+    }
+}
+
+func TestReplayTrace(t *testing.T) {
+    trace, err := ReadTrace(strings.NewReader(fixedTrace), 10)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cases := []struct {
+        name string
+        policy string
+        maxBytes int64
+        hits int
+        misses int
+        evictions int
+    }{
+        // a, a, b hits, then every key is evicted before reuse
+        {"lru", PolicyLRU, 0, 3, 9, 6},
+        // a is kept by frequency
+        {"lfu", PolicyLFU, 0, 4, 8, 5},
+        // c and a come back from ghost lists, but too late
+        {"arc", PolicyARC, 0, 3, 9, 6},
+        // only two entries fit by bytes
+        {"lru max_bytes", PolicyLRU, 25, 1, 11, 9},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            res, err := ReplayTrace(config.CacheConfig{Size: 3, Policy: tc.policy, MaxBytes: tc.maxBytes}, trace)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if res.Accesses != len(trace) || res.Hits != tc.hits || res.Misses != tc.misses || res.Evictions != tc.evictions {
+                t.Fatalf("accesses %d, hits %d, misses %d, evictions %d; want %d, %d, %d",
+                    res.Accesses, res.Hits, res.Misses, res.Evictions, tc.hits, tc.misses, tc.evictions)
+            }
+            if res.Entries > 3 || (tc.maxBytes > 0 && res.Bytes > tc.maxBytes) {
+                t.Fatalf("usage %d bytes, %d entries", res.Bytes, res.Entries)
+            }
+        })
+    }
+}
+
+// zipf trace as cache-bench builds it, byte limit below
+// size * payload, so both eviction paths are measured
+func BenchmarkReplayTrace(b *testing.B) {
+    zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 1, 9999)
+    trace := make([]TraceRecord, 100000)
+    for i := range trace {
+        trace[i] = TraceRecord{Key: fmt.Sprintf("order-%d", zipf.Uint64()), Size: 1024}
+    }
+    for _, policy := range []string{PolicyLRU, PolicyLFU, PolicyARC} {
+        b.Run(policy, func(b *testing.B) {
+            conf := config.CacheConfig{Size: 2048, Policy: policy, MaxBytes: 1 << 20}
+            var res ReplayResult
+            var err error
+            b.ReportAllocs()
+            b.ResetTimer()
+            for i := 0; i < b.N; i++ {
+                if res, err = ReplayTrace(conf, trace); err != nil {
+                    b.Fatal(err)
+                }
+            }
+            b.ReportMetric(res.HitRatio(), "hit-ratio")
+        })
+    }
+}
@@ -5,11 +5,19 @@ import (
     "errors"
     "context"
     "log/slog"
-    "sync"
     "time"
+
+    "github.com/bluele/gcache"
+    "golang.org/x/sync/singleflight"
+
+    "nats_app/internal/config"
+    "nats_app/internal/metrics"
 )
 
 const (
+    defaultNegativeSize int = 4096
+    // pending L2 writes, extra ones are dropped
+    l2QueueSize int = 256
     AddOne string = "add_one"
     AddMany string = "add_many"
     Evicted uint8 = 1
@@ -17,92 +25,6 @@ const (
     EmptyLog uint8 = 2
 )
 
-type ConcurrentLog interface {
-    Dump(context.Context, chan<- interface{})
-    LogEvicted(val interface{}) error
-    LogAdded(val interface{}) error
-}
-
-type LogMessage interface {
-    OpCode() uint8
-    Payload() string
-}
-
-type CacheLogMessage struct {
-    // operation: evict or add
-    op uint8
-    // key to fing record in DB
-    key string
-}
-
-func (clm CacheLogMessage) OpCode() uint8 {
-    return clm.op
-}
-
-func (clm CacheLogMessage) Payload() string {
-    return clm.key
-}
-
-type CacheLog struct {
-    lock sync.RWMutex
-    records []CacheLogMessage
-    limit uint32
-    size uint32
-}
-
-func (el *CacheLog) Dump(ctx *context.Context, in chan<- LogMessage, l *slog.Logger) {
-    (*el).lock.Lock()
-    mark := "CacheLod.Dump"
-    l.Debug(fmt.Sprintf("%s | Locked, run dump... | %d", mark, len((*el).records)))
-    defer (*el).lock.Unlock()
-    if (*el).records == nil {
-        select {
-        case in<- CacheLogMessage{EmptyLog, ""}:
-            return
-        case <-(*ctx).Done():
-            l.Debug(fmt.Sprintf("%s | Empty cache log...", mark))
-            return
-        }
-    }
-    for i := uint32(0); i < uint32(len((*el).records) - 1); i++ {
-        select {
-        case in<- (*el).records[i]:
-        case <-(*ctx).Done():
-            l.Debug(fmt.Sprintf("%s | Cancelled...", mark))
-            return
-        }
-    }
-    // this brach caller can`t close channel
-    defer close(in)
-    (*el).records = nil
-    l.Debug(fmt.Sprintf("%s | Dumped %v ...", mark, (*el).records))
-    return
-}
-
-func (el *CacheLog) LogEvicted(val string) error {
-    (*el).lock.Lock()
-    defer (*el).lock.Unlock()
-    if (*el).size == (*el).limit && (*el).limit > 0 {
-        return errors.New("Cache log overflow...")
-    }
-    (*el).records = append((*el).records, CacheLogMessage{Evicted, val})
-    return nil
-}
-
-func (el *CacheLog) LogAdded(val string) error {
-    (*el).lock.Lock()
-    defer (*el).lock.Unlock()
-    if (*el).size == (*el).limit && (*el).limit > 0 {
-        return errors.New("Cache log overflow...")
-    }
-    (*el).records = append((*el).records, CacheLogMessage{Added, val})
-    return nil
-}
-
-func NewCacheLog(limit uint32) *CacheLog {
-    return &CacheLog{limit: limit, lock: sync.RWMutex{}}
-}
-
 type CacheServIntf interface {
     SetOne(msg *struct{}) error
     SetMany(msg *struct{}) error
@@ -120,29 +42,125 @@ type AppCache struct {
     dump_it time.Duration
     income <-chan CacheItem
     errCh chan<- error
-    c *AppLRUCache
+    c MemCache
     evLog *CacheLog
+    // coalesced loads on miss
+    flight *singleflight.Group
+    loadWait time.Duration
+    // recently not found keys, nil if disabled
+    negative gcache.Cache
+    // shared between instances, nil if disabled
+    l2 *RedisL2
+    // L2 writes go in background, ingestion doesn`t wait for them
+    l2Queue chan []Order
 }
 
 func NewCacheService(
     ctx *context.Context,
     errch chan<- error,
-    cache *AppLRUCache,
+    cache MemCache,
     ) AppCache {
+    // default policy is always valid
+    evLog, _ := NewCacheLog(defaultLogLimit, LogOverflowFlush, (*ctx).Done())
     return AppCache{
         ctx:            ctx,
         errCh:          errch,
         c:              cache,
-        evLog:          NewCacheLog(2048),
+        evLog:          evLog,
+        flight:         &singleflight.Group{},
+    }
+}
+
+// bound for pending cache log keys and overflow policy,
+// call before cache is used
+func (ca *AppCache) SetLogPolicy(conf *config.CacheConfig) error {
+    evLog, err := NewCacheLog((*conf).LogLimit, (*conf).LogOverflow, (*(*ca).ctx).Done())
+    if err != nil {
+        return err
+    }
+    (*ca).evLog = evLog
+    return nil
+}
+
+// log overflow asks for sync before next tick
+func (ca *AppCache) FlushRequests() <-chan struct{} {
+    return (*ca.evLog).FlushRequests()
+}
+
+// bounded wait for loads on miss and
+// negative cache for not found keys
+func (ca *AppCache) SetMissPolicy(conf *config.CacheConfig) {
+    (*ca).loadWait = (*conf).LoadWait
+    if (*conf).NegativeTTL <= 0 {
+        (*ca).negative = nil
+        return
     }
+    size := (*conf).NegativeSize
+    if size <= 0 {
+        size = defaultNegativeSize
+    }
+    (*ca).negative = gcache.New(size).
+        LRU().
+        Expiration((*conf).NegativeTTL).
+        Build()
+}
+
+// second tier between memory and db
+// writer is started by Run
+func (ca *AppCache) SetL2(l2 *RedisL2) {
+    (*ca).l2 = l2
+    (*ca).l2Queue = make(chan []Order, l2QueueSize)
+}
+
+// L2 circuit state for health checks
+func (ca *AppCache) L2Status() ComponentStatus {
+    if (*ca).l2 == nil {
+        return ComponentStatus{Ok: true, Details: map[string]any{"enabled": false}}
+    }
+    state := (*ca).l2.State()
+    status := ComponentStatus{
+        // optional tier, db serves reads while circuit is open
+        Ok: true,
+        Details: map[string]any{"enabled": true, "breaker": state.String()},
+    }
+    if state != BreakerClosed {
+        status.Error = "L2 cache is degraded, reads go to db"
+    }
+    return status
+}
+
+// key is stored now, drop it from negative cache
+func (ca *AppCache) forgetMissing(key string) {
+    if (*ca).negative != nil {
+        (*ca).negative.Remove(key)
+    }
+}
+
+// cache log records waiting for sync with db
+func (ca *AppCache) PendingLog() int {
+    return (*ca.evLog).Pending()
+}
+
+// payload bytes, entries and largest items
+func (ca *AppCache) Stats() CacheStats {
+    return (*ca).c.Stats()
+}
+
+// payload bytes and entries
+func (ca *AppCache) Usage() (int64, int) {
+    return (*ca).c.Usage()
 }
 
 func (ca *AppCache) MarkEvicted(key string) {
-    (*ca.evLog).LogEvicted(key)
+    if err := (*ca.evLog).LogEvicted(key); err != nil {
+        (*ca).log.Warn(fmt.Sprintf("AppCache.MarkEvicted | Key %s: %s, oldest pending key dropped", key, err.Error()))
+    }
 }
 
 func (ca *AppCache) MarkAdded(key string) {
-    (*ca.evLog).LogAdded(key)
+    if err := (*ca.evLog).LogAdded(key); err != nil {
+        (*ca).log.Warn(fmt.Sprintf("AppCache.MarkAdded | Key %s: %s, oldest pending key dropped", key, err.Error()))
+    }
 }
 
 func (ca *AppCache) Listen(ch <-chan CacheItem) {
@@ -156,6 +174,10 @@ func (ca *AppCache) SetLogger(log *slog.Logger) {
 
 func (ca *AppCache) Run() {
 
+    if (*ca).l2 != nil {
+        go (*ca).writeL2()
+    }
+
     // cache swap service
     go func(c *AppCache) {
         var syncErr error
@@ -188,13 +210,27 @@ func (ca *AppCache) Run() {
     }(ca)
 }
 
-func (ca *AppCache) GetCacheSync(it time.Duration, cb func(<-chan LogMessage, func())) func() {
+func (ca *AppCache) GetCacheSync(it time.Duration, cb func(<-chan LogMessage, func()) bool) func() <-chan struct{} {
     // evicted and added dump service
     // <main> func use ticker for
     // call this func and sync objects states in DB.
-    return func() {
+    // cb returns false if nothing was committed, dumped
+    // records go back to log then.
+    // Returned channel is closed when sync finished.
+    return func() <-chan struct{} {
         dump_ch := make(chan LogMessage)
-        call := cb
+        done := make(chan struct{})
+        sent := make(chan []CacheLogMessage, 1)
+        call := func(ch <-chan LogMessage, cancel func()) {
+            defer close(done)
+            committed := cb(ch, cancel)
+            // cb cancelled dump, it returns soon
+            records := <-sent
+            if !committed && len(records) > 0 {
+                (*ca).log.Warn(fmt.Sprintf("AppCache.DumpBackground | Sync failed, %d records back to log...", len(records)))
+                (*ca.evLog).Requeue(records)
+            }
+        }
         intvl := it
         go func(c *AppCache, dump chan LogMessage, cb func(<-chan LogMessage, func()), i time.Duration) {
             mark := "AppCache.DumpBackground"
@@ -202,14 +238,16 @@ func (ca *AppCache) GetCacheSync(it time.Duration, cb func(<-chan LogMessage, fu
             select {
             case <-(*c.ctx).Done():
                 defer close(dump_ch)
+                defer close(done)
                 return
             default:
                 (*c).log.Debug(fmt.Sprintf("%s | Run cache dump...", mark))
                 tmpCtx, cancel := context.WithTimeout(*c.ctx, i)
                 go cb(dump, cancel)
-                go (*c).evLog.Dump(&tmpCtx, dump, c.log)
+                go func() {sent<- (*c).evLog.Dump(&tmpCtx, dump, c.log)}()
             }
         }(ca, dump_ch, call, intvl)
+        return done
     }
 }
 
@@ -220,29 +258,181 @@ func (ca *AppCache) SetOne(item CacheItem) error {
         return errors.New(msg)
     }
     msg := item.payload.(Order)
-    _, err := (*ca).c.Setex(msg.Id(), msg.GetPayload(), (*ca).c.ExpT)
+    (*ca).forgetMissing(msg.Id())
+    // backpressure on full log, cache is not locked yet
+    if err := (*ca.evLog).Admit(); err != nil {
+        return fmt.Errorf("%s, error %w", mark, err)
+    }
+    _, err := (*ca).c.Setex(msg.Id(), msg.GetPayload(), (*ca).c.TTL())
     if err != nil {
         return fmt.Errorf("%s, error %w", mark, err)
     }
+    (*ca).populateL2(msg)
     return nil
 }
 
 func (ca *AppCache) SetMany(item CacheItem) error {
+    orders := item.payload.(Orders)
+    return (*ca).setMany(orders.GetItems(), true)
+}
+
+// admit - wait for room in cache log, http path doesn`t wait
+func (ca *AppCache) setMany(orders []Order, admit bool) error {
     mark := "AppCache.SetMany"
     if (*ca).c == nil {
         msg := fmt.Sprintf("%s, error Cache not set.", mark)
         return errors.New(msg)
     }
-    orders := item.payload.(Orders)
-    for _, order := range orders.GetItems() {
-        _, err := (*ca).c.Setex(order.Oid, order.Payload, (*ca).c.ExpT)
+    stored := make([]Order, 0, len(orders))
+    for _, order := range orders {
+        (*ca).forgetMissing(order.Oid)
+        if (*ca).c.Has(order.Oid) {
+            // already loaded from snapshot or fresh message
+            continue
+        }
+        if admit {
+            if err := (*ca.evLog).Admit(); err != nil {
+                return fmt.Errorf("%s: error %w", mark, err)
+            }
+        }
+        _, err := (*ca).c.Setex(order.Oid, order.Payload, (*ca).c.TTL())
         if err != nil {
             return fmt.Errorf("%s: error %w", mark, err)
         }
+        stored = append(stored, order)
     }
+    (*ca).populateL2(stored...)
     return nil
 }
 
+// queue orders for L2 write, never waits: L2 is optional
+// and a lost write only costs db lookup on other instance
+func (ca *AppCache) populateL2(orders ...Order) {
+    if (*ca).l2 == nil || len(orders) == 0 {
+        return
+    }
+    select {
+    case (*ca).l2Queue<- orders:
+    default:
+        metrics.CacheL2Requests.WithLabelValues("dropped").Inc()
+    }
+}
+
+// L2 failures are not reported, lookups fall back to db
+func (ca *AppCache) writeL2() {
+    mark := "AppCache.writeL2"
+    for {
+        select {
+        case <-(*ca.ctx).Done():
+            return
+        case orders := <-(*ca).l2Queue:
+            if err := (*ca).l2.Set(*ca.ctx, orders...); err != nil && !errors.Is(err, L2Unavailable) {
+                (*ca).log.Warn(fmt.Sprintf("%s | %s", mark, err.Error()))
+            }
+        }
+    }
+}
+
+// lookup in shared L2 before db
+func (ca *AppCache) fromL2(key string) (Order, bool) {
+    if (*ca).l2 == nil {
+        return Order{}, false
+    }
+    ordr, err := (*ca).l2.Get(*ca.ctx, key)
+    if err != nil {
+        if !errors.Is(err, L2Miss) && !errors.Is(err, L2Unavailable) {
+            (*ca).log.Warn(fmt.Sprintf("AppCache.fromL2 | %s", err.Error()))
+        }
+        return Order{}, false
+    }
+    return ordr, true
+}
+
+// lookup keys in memory only. Keys to load from db and
+// keys known as absent (negative cache) are returned in request order
+func (ca *AppCache) GetMany(keys []string) (map[string]Order, []string, []string) {
+    found := make(map[string]Order, len(keys))
+    var missing, absent []string
+    for _, key := range keys {
+        ord, err := (*ca).c.Get(key)
+        if err == nil {
+            metrics.CacheHits.Inc()
+            found[key] = ord
+            continue
+        }
+        metrics.CacheMisses.Inc()
+        if (*ca).negative != nil && (*ca).negative.Has(key) {
+            metrics.CacheNegativeHits.Inc()
+            absent = append(absent, key)
+            continue
+        }
+        missing = append(missing, key)
+    }
+    return found, missing, absent
+}
+
+// put orders loaded from db into cache,
+// confirmed missing keys go to negative cache
+func (ca *AppCache) Backfill(orders []Order, notFound []string) error {
+    if (*ca).negative != nil {
+        for _, key := range notFound {
+            (*ca).negative.Set(key, struct{}{})
+        }
+    }
+    if len(orders) == 0 {
+        return nil
+    }
+    return (*ca).setMany(orders, false)
+}
+
+// concurrent misses for same key share one db load,
+// each caller waits not longer than load_wait
+func (ca *AppCache) load(key string) (Order, error) {
+    mark := "AppCache.load"
+    ch := (*ca).flight.DoChan(key, func() (interface{}, error) {
+        if ordr, ok := (*ca).fromL2(key); ok {
+            (*ca).c.Setex(ordr.Oid, ordr.Payload, (*ca).c.TTL())
+            return ordr, nil
+        }
+        ordr, err := (*ca).c.Load(key)
+        if err != nil {
+            // nothing to cache: order not found or db failed
+            if errors.Is(err, OrderNotFound) {
+                metrics.CacheLoads.WithLabelValues("not_found").Inc()
+                if (*ca).negative != nil {
+                    (*ca).negative.Set(key, struct{}{})
+                }
+            } else {
+                metrics.CacheLoads.WithLabelValues("error").Inc()
+            }
+            return Order{}, err
+        }
+        metrics.CacheLoads.WithLabelValues("ok").Inc()
+        (*ca).c.Setex(ordr.Oid, ordr.Payload, (*ca).c.TTL())
+        (*ca).populateL2(ordr)
+        return ordr, nil
+    })
+    var timeout <-chan time.Time
+    if (*ca).loadWait > 0 {
+        timer := time.NewTimer((*ca).loadWait)
+        defer timer.Stop()
+        timeout = timer.C
+    }
+    select {
+    case res := <-ch:
+        if res.Shared {
+            metrics.CacheLoadsShared.Inc()
+        }
+        if res.Err != nil {
+            return Order{}, res.Err
+        }
+        return res.Val.(Order), nil
+    case <-timeout:
+        // load goes on and will fill cache
+        return Order{}, fmt.Errorf("%s | Key %s: %w", mark, key, CacheLoadTimeout)
+    }
+}
+
 func (ca *AppCache) Get(key string) (Order, error) {
     mark := "AppCache.Get"
     var err error
@@ -252,10 +442,19 @@ func (ca *AppCache) Get(key string) (Order, error) {
     }
     ord, err := (*ca).c.Get(key)
     if err != nil {
+        metrics.CacheMisses.Inc()
+        if (*ca).negative != nil && (*ca).negative.Has(key) {
+            // confirmed missing recently, don`t ask db again
+            metrics.CacheNegativeHits.Inc()
+            return Order{}, fmt.Errorf("%s | %w", mark, OrderNotFound)
+        }
         // if no key, we have to fetch them from db
-        ordr := (*ca).c.On_load(key)
-        (*ca).c.Setex(ordr.Oid, ordr.Payload, (*ca).c.ExpT)
+        ordr, err := (*ca).load(key)
+        if err != nil {
+            return Order{}, fmt.Errorf("%s | %w", mark, err)
+        }
         return ordr, nil
     }
+    metrics.CacheHits.Inc()
     return ord, nil
 }
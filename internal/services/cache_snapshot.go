@@ -0,0 +1,224 @@
+package services
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "io"
+    "os"
+    "path/filepath"
+    "time"
+
+    "nats_app/internal/metrics"
+)
+
+// snapshot file layout:
+// magic | version u8 | created unix nano i64 | count uvarint |
+// entries (key len uvarint, key, expires unix nano i64, payload len uvarint, payload) |
+// crc32 (Castagnoli) of everything above, u32 big endian.
+// Entries go from least to most recently used.
+const (
+    snapshotMagic string = "NAPPSNAP"
+    snapshotVersion uint8 = 1
+)
+
+var (
+    SnapshotCorrupt = errors.New("Cache snapshot is corrupted")
+    SnapshotStale = errors.New("Cache snapshot is too old")
+    crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+func writeUvarint(w io.Writer, v uint64) error {
+    var buf [binary.MaxVarintLen64]byte
+    n := binary.PutUvarint(buf[:], v)
+    _, err := w.Write(buf[:n])
+    return err
+}
+
+// write snapshot into tmp file and rename it,
+// previous snapshot stays valid on failure
+func WriteSnapshot(path string, entries []CacheEntry, created time.Time) error {
+    mark := "services.WriteSnapshot"
+    tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path) + ".tmp*")
+    if err != nil {
+        return fmt.Errorf("%s | Error %w", mark, err)
+    }
+    defer os.Remove(tmp.Name())
+    defer tmp.Close()
+
+    crc := crc32.New(crcTable)
+    buf := bufio.NewWriter(io.MultiWriter(tmp, crc))
+    buf.WriteString(snapshotMagic)
+    buf.WriteByte(snapshotVersion)
+    binary.Write(buf, binary.BigEndian, created.UnixNano())
+    writeUvarint(buf, uint64(len(entries)))
+    for _, ent := range entries {
+        var expires int64
+        if !ent.Expires.IsZero() {
+            expires = ent.Expires.UnixNano()
+        }
+        writeUvarint(buf, uint64(len(ent.Key)))
+        buf.WriteString(ent.Key)
+        binary.Write(buf, binary.BigEndian, expires)
+        writeUvarint(buf, uint64(len(*ent.Payload)))
+        buf.Write(*ent.Payload)
+    }
+    // bufio keeps first write error
+    if err = buf.Flush(); err != nil {
+        return fmt.Errorf("%s | Error %w", mark, err)
+    }
+    if err = binary.Write(tmp, binary.BigEndian, crc.Sum32()); err != nil {
+        return fmt.Errorf("%s | Error %w", mark, err)
+    }
+    if err = tmp.Sync(); err != nil {
+        return fmt.Errorf("%s | Error %w", mark, err)
+    }
+    if err = tmp.Close(); err != nil {
+        return fmt.Errorf("%s | Error %w", mark, err)
+    }
+    if err = os.Rename(tmp.Name(), path); err != nil {
+        return fmt.Errorf("%s | Error %w", mark, err)
+    }
+    return nil
+}
+
+// read and validate snapshot, entries older than maxAge
+// are rejected (0 - any age)
+func ReadSnapshot(path string, maxAge time.Duration) ([]CacheEntry, time.Time, error) {
+    mark := "services.ReadSnapshot"
+    var created time.Time
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, created, fmt.Errorf("%s | Error %w", mark, err)
+    }
+    if len(data) < len(snapshotMagic) + 1 + 8 + 4 {
+        return nil, created, fmt.Errorf("%s | Too short: %w", mark, SnapshotCorrupt)
+    }
+    body, sum := data[:len(data) - 4], data[len(data) - 4:]
+    if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(sum) {
+        return nil, created, fmt.Errorf("%s | Checksum mismatch: %w", mark, SnapshotCorrupt)
+    }
+    if string(body[:len(snapshotMagic)]) != snapshotMagic || body[len(snapshotMagic)] != snapshotVersion {
+        return nil, created, fmt.Errorf("%s | Unknown format: %w", mark, SnapshotCorrupt)
+    }
+    r := bytes.NewReader(body[len(snapshotMagic) + 1:])
+    var createdNs int64
+    binary.Read(r, binary.BigEndian, &createdNs)
+    created = time.Unix(0, createdNs)
+    if maxAge > 0 && time.Since(created) > maxAge {
+        return nil, created, fmt.Errorf("%s | Created %s: %w", mark, created, SnapshotStale)
+    }
+    count, err := binary.ReadUvarint(r)
+    if err != nil || count > uint64(r.Len()) {
+        return nil, created, fmt.Errorf("%s | Invalid count: %w", mark, SnapshotCorrupt)
+    }
+    entries := make([]CacheEntry, 0, count)
+    for i := uint64(0); i < count; i++ {
+        key, err := readChunk(r)
+        if err != nil {
+            return nil, created, fmt.Errorf("%s | Entry %d: %w", mark, i, SnapshotCorrupt)
+        }
+        var expires int64
+        if err = binary.Read(r, binary.BigEndian, &expires); err != nil {
+            return nil, created, fmt.Errorf("%s | Entry %d: %w", mark, i, SnapshotCorrupt)
+        }
+        payload, err := readChunk(r)
+        if err != nil {
+            return nil, created, fmt.Errorf("%s | Entry %d: %w", mark, i, SnapshotCorrupt)
+        }
+        ent := CacheEntry{Key: string(key), Payload: &payload}
+        if expires != 0 {
+            ent.Expires = time.Unix(0, expires)
+        }
+        entries = append(entries, ent)
+    }
+    if r.Len() != 0 {
+        return nil, created, fmt.Errorf("%s | Trailing data: %w", mark, SnapshotCorrupt)
+    }
+    return entries, created, nil
+}
+
+func readChunk(r *bytes.Reader) ([]byte, error) {
+    size, err := binary.ReadUvarint(r)
+    if err != nil {
+        return nil, err
+    }
+    if size > uint64(r.Len()) {
+        return nil, io.ErrUnexpectedEOF
+    }
+    chunk := make([]byte, size)
+    _, err = io.ReadFull(r, chunk)
+    return chunk, err
+}
+
+// save current cache content
+func (ca *AppCache) SaveSnapshot(path string) (int, error) {
+    entries := (*ca).c.Entries()
+    if err := WriteSnapshot(path, entries, time.Now()); err != nil {
+        return 0, err
+    }
+    return len(entries), nil
+}
+
+// fill cache from snapshot, expired items are skipped.
+// Items are set in recorded order, so recency is kept.
+// Returns loaded keys, db restore skips them.
+func (ca *AppCache) LoadSnapshot(path string, maxAge time.Duration) ([]string, error) {
+    mark := "AppCache.LoadSnapshot"
+    entries, _, err := ReadSnapshot(path, maxAge)
+    if err != nil {
+        return nil, err
+    }
+    now := time.Now()
+    loaded := make([]string, 0, len(entries))
+    for _, ent := range entries {
+        var ok bool
+        switch {
+        case ent.Expires.IsZero():
+            ok, err = (*ca).c.Set(ent.Key, ent.Payload)
+        case ent.Expires.After(now):
+            ok, err = (*ca).c.Setex(ent.Key, ent.Payload, ent.Expires.Sub(now))
+        default:
+            // stale, db restore will bring it back if needed
+            continue
+        }
+        if err != nil {
+            return loaded, fmt.Errorf("%s | Error %w", mark, err)
+        }
+        if ok {
+            (*ca).forgetMissing(ent.Key)
+            loaded = append(loaded, ent.Key)
+        }
+    }
+    return loaded, nil
+}
+
+// write snapshot each interval until ctx is done
+func (ca *AppCache) RunSnapshots(path string, interval time.Duration) {
+    if interval <= 0 {
+        return
+    }
+    go func(c *AppCache) {
+        mark := "AppCache.RunSnapshots"
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-(*c.ctx).Done():
+                return
+            case <-ticker.C:
+                start := time.Now()
+                n, err := (*c).SaveSnapshot(path)
+                if err != nil {
+                    (*c).log.Error(fmt.Sprintf("%s | Error: %s", mark, err.Error()))
+                    continue
+                }
+                metrics.CacheSnapshotDuration.Observe(time.Since(start).Seconds())
+                (*c).log.Debug(fmt.Sprintf("%s | Saved %d items...", mark, n))
+            }
+        }
+    }(ca)
+}
@@ -0,0 +1,133 @@
+package services
+
+import (
+    "errors"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "nats_app/internal/config"
+)
+
+func snapshotEntries() []CacheEntry {
+    a, b := []byte(`{"a":1}`), []byte{}
+    return []CacheEntry{
+        {Key: "a", Payload: &a},
+        {Key: "b", Payload: &b, Expires: time.Unix(0, 1700000000123456789)},
+    }
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "cache.snap")
+    created := time.Unix(0, 1700000000000000001)
+    if err := WriteSnapshot(path, snapshotEntries(), created); err != nil {
+        t.Fatal(err)
+    }
+    got, at, err := ReadSnapshot(path, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !at.Equal(created) {
+        t.Fatalf("created %s, want %s", at, created)
+    }
+    want := snapshotEntries()
+    if len(got) != len(want) {
+        t.Fatalf("got %d entries, want %d", len(got), len(want))
+    }
+    for i := range want {
+        if got[i].Key != want[i].Key || string(*got[i].Payload) != string(*want[i].Payload) ||
+            !got[i].Expires.Equal(want[i].Expires) {
+            t.Fatalf("entry %d: got %+v, want %+v", i, got[i], want[i])
+        }
+    }
+    // no temp files left
+    if files, _ := filepath.Glob(path + ".tmp*"); len(files) != 0 {
+        t.Fatalf("temp files left: %v", files)
+    }
+}
+
+func TestSnapshotInvalid(t *testing.T) {
+    dir := t.TempDir()
+    valid := filepath.Join(dir, "valid.snap")
+    if err := WriteSnapshot(valid, snapshotEntries(), time.Now()); err != nil {
+        t.Fatal(err)
+    }
+    data, _ := os.ReadFile(valid)
+    cases := []struct {
+        name string
+        data func() []byte
+        maxAge time.Duration
+        want error
+    }{
+        {
+            name: "flipped byte",
+            data: func() []byte {
+                d := append([]byte{}, data...)
+                d[len(d) / 2] ^= 0xff
+                return d
+            },
+            want: SnapshotCorrupt,
+        },
+        {
+            name: "truncated",
+            data: func() []byte {return data[:len(data) - 3]},
+            want: SnapshotCorrupt,
+        },
+        {
+            name: "too short",
+            data: func() []byte {return data[:5]},
+            want: SnapshotCorrupt,
+        },
+        {
+            name: "stale",
+            data: func() []byte {return data},
+            maxAge: time.Nanosecond,
+            want: SnapshotStale,
+        },
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            path := filepath.Join(dir, tc.name)
+            if err := os.WriteFile(path, tc.data(), 0o600); err != nil {
+                t.Fatal(err)
+            }
+            time.Sleep(time.Millisecond)
+            if _, _, err := ReadSnapshot(path, tc.maxAge); !errors.Is(err, tc.want) {
+                t.Fatalf("want %v, got %v", tc.want, err)
+            }
+        })
+    }
+    if _, _, err := ReadSnapshot(filepath.Join(dir, "missing"), 0); !errors.Is(err, os.ErrNotExist) {
+        t.Fatalf("missing file: %v", err)
+    }
+}
+
+func TestLoadSnapshotSkipsExpired(t *testing.T) {
+    mem, err := NewMemCache(&config.CacheConfig{Size: 10, Exp_time: time.Minute}).Build()
+    if err != nil {
+        t.Fatal(err)
+    }
+    ca := AppCache{c: mem}
+    payload := []byte(`{}`)
+    path := filepath.Join(t.TempDir(), "cache.snap")
+    entries := []CacheEntry{
+        {Key: "old", Payload: &payload, Expires: time.Now().Add(-time.Second)},
+        {Key: "live", Payload: &payload, Expires: time.Now().Add(time.Minute)},
+        {Key: "forever", Payload: &payload},
+    }
+    if err := WriteSnapshot(path, entries, time.Now()); err != nil {
+        t.Fatal(err)
+    }
+    loaded, err := ca.LoadSnapshot(path, time.Hour)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // expired key is left for db restore
+    if len(loaded) != 2 || loaded[0] != "live" || loaded[1] != "forever" {
+        t.Fatalf("loaded %v", loaded)
+    }
+    if mem.Has("old") || !mem.Has("live") || !mem.Has("forever") {
+        t.Fatal("cache content doesn`t match snapshot")
+    }
+}
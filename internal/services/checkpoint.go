@@ -0,0 +1,168 @@
+package services
+
+import (
+    "fmt"
+    "errors"
+    "sort"
+    "sync"
+
+    "github.com/jackc/pgx/v5"
+
+    "nats_app/internal/storage/psql"
+)
+
+// stored value is low-watermark of persisted sequences, written
+// in the same transaction as order. Concurrent transactions may
+// commit out of order, so it never moves back.
+const saveCheckpointQuery string = `INSERT INTO consumer_checkpoints (durable_name, last_seq)
+    VALUES ($1, $2)
+    ON CONFLICT (durable_name) DO UPDATE
+    SET last_seq = GREATEST(consumer_checkpoints.last_seq, EXCLUDED.last_seq),
+        updated_at = now()`
+
+// set name of durable subscription, checkpoints are stored under it
+func (srv *AppStorage) SetCheckpointName(name string) {
+    (*srv).checkpoint = name
+}
+
+// low-watermark of persisted sequences: every received
+// sequence up to mark is persisted. Orders are saved concurrently,
+// seq N+1 may commit while N is in flight or failed.
+type seqWatermark struct {
+    mu sync.Mutex
+    mark uint64
+    // tracked sequences above mark, ascending. First one is
+    // always pending, persisted ones after it wait for it.
+    seqs []uint64
+    // tracked seq -> persisted
+    state map[uint64]bool
+}
+
+func newSeqWatermark() *seqWatermark {
+    return &seqWatermark{
+        state: make(map[uint64]bool),
+    }
+}
+
+// must be called under lock
+func (w *seqWatermark) track(seq uint64) {
+    (*w).state[seq] = false
+    n := len((*w).seqs)
+    if n == 0 || seq > (*w).seqs[n - 1] {
+        // delivery order, common case
+        (*w).seqs = append((*w).seqs, seq)
+        return
+    }
+    i := sort.Search(n, func(i int) bool {return (*w).seqs[i] >= seq})
+    (*w).seqs = append((*w).seqs, 0)
+    copy((*w).seqs[i + 1:], (*w).seqs[i:])
+    (*w).seqs[i] = seq
+}
+
+// call in delivery order, before message is saved
+func (w *seqWatermark) received(seq uint64) {
+    (*w).mu.Lock()
+    defer (*w).mu.Unlock()
+    if seq <= (*w).mark {
+        // redelivered, already persisted
+        return
+    }
+    if _, ok := (*w).state[seq]; ok {
+        // redelivered, wait for it again
+        (*w).state[seq] = false
+        return
+    }
+    (*w).track(seq)
+}
+
+// watermark if seq is persisted now, false if it doesn`t move.
+// Doesn`t change state: value is written with seq in one transaction.
+func (w *seqWatermark) next(seq uint64) (uint64, bool) {
+    (*w).mu.Lock()
+    defer (*w).mu.Unlock()
+    if seq <= (*w).mark {
+        return (*w).mark, false
+    }
+    seqs := (*w).seqs
+    if len(seqs) > 0 && seqs[0] < seq {
+        // lower one is pending
+        return (*w).mark, false
+    }
+    i := 0
+    if len(seqs) > 0 && seqs[0] == seq {
+        i = 1
+    }
+    next := seq
+    for ; i < len(seqs) && (*w).state[seqs[i]]; i++ {
+        next = seqs[i]
+    }
+    return next, true
+}
+
+// mark seq as persisted, returns new watermark if it moved
+func (w *seqWatermark) persisted(seq uint64) (uint64, bool) {
+    (*w).mu.Lock()
+    defer (*w).mu.Unlock()
+    if seq <= (*w).mark {
+        return (*w).mark, false
+    }
+    if _, ok := (*w).state[seq]; !ok {
+        (*w).track(seq)
+    }
+    (*w).state[seq] = true
+    moved := false
+    for len((*w).seqs) > 0 && (*w).state[(*w).seqs[0]] {
+        (*w).mark = (*w).seqs[0]
+        delete((*w).state, (*w).mark)
+        (*w).seqs = (*w).seqs[1:]
+        moved = true
+    }
+    return (*w).mark, moved
+}
+
+// message is received from broker, seq == 0 - not from broker
+func (srv AppStorage) receiveSeq(seq uint64) {
+    if seq == 0 || srv.checkpoint == "" {
+        return
+    }
+    srv.seqs.received(seq)
+}
+
+// add checkpoint upsert into transaction that persists seq,
+// checkpoint and message are committed together
+func (srv AppStorage) queueCheckpoint(tr *psql.Transaction, seq uint64) {
+    if seq == 0 || srv.checkpoint == "" {
+        return
+    }
+    if last, moved := srv.seqs.next(seq); moved {
+        tr.AddQuery(saveCheckpointQuery, srv.checkpoint, int64(last))
+    }
+}
+
+// message is committed (or was stored before: duplicate).
+// Duplicates write nothing, next transaction carries their seq.
+func (srv AppStorage) commitSeq(seq uint64) {
+    if seq == 0 || srv.checkpoint == "" {
+        return
+    }
+    srv.seqs.persisted(seq)
+}
+
+// last fully persisted message sequence,
+// found == false if consumer never stored anything
+func (srv AppStorage) LastCheckpoint() (seq uint64, found bool, err error) {
+    mark := "AppStorage.LastCheckpoint"
+    query := "SELECT last_seq FROM consumer_checkpoints WHERE durable_name = $1"
+    var last int64
+    err = srv.db.FetchOne(query, srv.checkpoint).ParseInto(&last)
+    if errors.Is(err, pgx.ErrNoRows) {
+        return 0, false, nil
+    }
+    if err != nil {
+        return 0, false, classifyDBError(mark, err)
+    }
+    if last < 0 {
+        return 0, false, fmt.Errorf("%s | Invalid sequence %d", mark, last)
+    }
+    return uint64(last), true, nil
+}
@@ -0,0 +1,133 @@
+package services
+
+import (
+    "testing"
+)
+
+func TestSeqWatermark(t *testing.T) {
+    type step struct {
+        // received or persisted
+        recv bool
+        seq uint64
+        // expected watermark after step
+        mark uint64
+    }
+    recv := func(seq, mark uint64) step {return step{true, seq, mark}}
+    done := func(seq, mark uint64) step {return step{false, seq, mark}}
+    cases := []struct {
+        name string
+        steps []step
+    }{
+        {
+            name: "in order",
+            steps: []step{recv(1, 0), done(1, 1), recv(2, 1), done(2, 2)},
+        },
+        {
+            name: "newer commits first",
+            steps: []step{recv(1, 0), recv(2, 0), recv(3, 0), done(3, 0), done(2, 0), done(1, 3)},
+        },
+        {
+            name: "failed seq holds watermark",
+            steps: []step{recv(1, 0), recv(2, 0), recv(3, 0), done(1, 1), done(3, 1)},
+        },
+        {
+            name: "redelivered failed seq",
+            steps: []step{recv(1, 0), recv(2, 0), done(2, 0), recv(1, 0), done(1, 2)},
+        },
+        {
+            name: "redelivered persisted seq",
+            steps: []step{recv(1, 0), done(1, 1), recv(1, 1), done(1, 1)},
+        },
+        {
+            // dead letters and sequences of other channels are never received
+            name: "gaps",
+            steps: []step{recv(5, 0), recv(9, 0), done(9, 0), done(5, 9)},
+        },
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            w := newSeqWatermark()
+            for i, st := range tc.steps {
+                if st.recv {
+                    w.received(st.seq)
+                } else {
+                    w.persisted(st.seq)
+                }
+                if w.mark != st.mark {
+                    t.Fatalf("step %d (%v): mark %d, want %d", i, st, w.mark, st.mark)
+                }
+            }
+        })
+    }
+}
+
+func TestSeqWatermarkMoved(t *testing.T) {
+    w := newSeqWatermark()
+    w.received(1)
+    w.received(2)
+    if _, moved := w.persisted(2); moved {
+        t.Fatal("moved over pending seq")
+    }
+    if last, moved := w.persisted(1); !moved || last != 2 {
+        t.Fatalf("got %d %v, want 2 true", last, moved)
+    }
+    if len(w.state) != 0 || len(w.seqs) != 0 {
+        t.Fatalf("state is not cleaned: %v %v", w.state, w.seqs)
+    }
+}
+
+// value written in transaction of seq
+func TestSeqWatermarkNext(t *testing.T) {
+    cases := []struct {
+        name string
+        received []uint64
+        persisted []uint64
+        seq uint64
+        want uint64
+        moved bool
+    }{
+        {name: "only one", received: []uint64{1}, seq: 1, want: 1, moved: true},
+        {name: "lower pending", received: []uint64{1, 2}, seq: 2, want: 0},
+        {name: "carries persisted run", received: []uint64{1, 2, 3, 4}, persisted: []uint64{2, 3}, seq: 1, want: 3, moved: true},
+        {name: "already persisted", received: []uint64{1}, persisted: []uint64{1}, seq: 1, want: 1},
+        {name: "not received", received: []uint64{5}, seq: 3, want: 3, moved: true},
+        {name: "out of order delivery", received: []uint64{4, 2}, persisted: []uint64{4}, seq: 2, want: 4, moved: true},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            w := newSeqWatermark()
+            for _, seq := range tc.received {
+                w.received(seq)
+            }
+            for _, seq := range tc.persisted {
+                w.persisted(seq)
+            }
+            before := w.mark
+            got, moved := w.next(tc.seq)
+            if got != tc.want || moved != tc.moved {
+                t.Fatalf("next(%d) = %d %v, want %d %v", tc.seq, got, moved, tc.want, tc.moved)
+            }
+            if w.mark != before {
+                t.Fatal("next changed watermark")
+            }
+            // stored value is what persisted gives after commit
+            if last, _ := w.persisted(tc.seq); tc.moved && last != tc.want {
+                t.Fatalf("persisted(%d) = %d, next gave %d", tc.seq, last, tc.want)
+            }
+        })
+    }
+}
+
+func BenchmarkSeqWatermark(b *testing.B) {
+    w := newSeqWatermark()
+    // 64 orders in flight
+    const inflight = 64
+    for i := 0; i < b.N; i++ {
+        seq := uint64(i + 1)
+        w.received(seq)
+        if seq > inflight {
+            w.next(seq - inflight)
+            w.persisted(seq - inflight)
+        }
+    }
+}
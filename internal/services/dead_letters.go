@@ -0,0 +1,241 @@
+package services
+
+import (
+    "fmt"
+    "errors"
+    "time"
+    "encoding/json"
+
+    "github.com/jackc/pgx/v5"
+    valid "github.com/go-playground/validator/v10"
+
+    "nats_app/internal/metrics"
+    "nats_app/internal/storage"
+)
+
+var (
+    DeadLetterNotFound = errors.New("Dead letter not found")
+    InvalidOrder = errors.New("Invalid order")
+    // validator is safe for concurrent use
+    orderValidator = valid.New()
+)
+
+// raw message received from broker
+type InMsg struct {
+    Subject string
+    Sequence uint64
+    Timestamp time.Time
+    Data []byte
+    // confirm message to broker
+    Ack func() error
+}
+
+// message that can`t be decoded or validated
+type DeadLetter struct {
+    Id int64
+    Subject string
+    Sequence uint64
+    Timestamp time.Time
+    Raw []byte
+    Error string
+    CreatedAt time.Time
+    ResubmittedAt *time.Time
+}
+
+// decode and validate raw order
+func DecodeOrder(data []byte) (storage.CustomerOrder, error) {
+    var ordModel storage.CustomerOrder
+    if err := json.Unmarshal(data, &ordModel); err != nil {
+        return ordModel, fmt.Errorf("%w: %w", InvalidOrder, err)
+    }
+    if err := orderValidator.Struct(ordModel); err != nil {
+        return ordModel, fmt.Errorf("%w: Validation error: %w", InvalidOrder, err)
+    }
+    return ordModel, nil
+}
+
+// normal ingestion pipeline: decode, validate and save order.
+// Invalid messages are moved to dead letters and acked,
+// returned error is wrapped InvalidOrder.
+func (srv AppStorage) Ingest(msg InMsg) error {
+    mark := "AppStorage.Ingest"
+    metrics.MessagesReceived.Inc()
+    // in delivery order, checkpoint waits for this seq
+    srv.receiveSeq(msg.Sequence)
+    ordModel, err := DecodeOrder(msg.Data)
+    if err != nil {
+        metrics.MessagesRejected.Inc()
+        err = fmt.Errorf("%s: msg_id %d, %w", mark, msg.Sequence, err)
+        dl := DeadLetter{
+            Subject: msg.Subject,
+            Sequence: msg.Sequence,
+            Timestamp: msg.Timestamp,
+            Raw: msg.Data,
+            Error: err.Error(),
+        }
+        if DLErr := srv.SaveDeadLetter(dl); DLErr != nil {
+            // not acked, will be redelivered
+            return fmt.Errorf("%s | Dead letter not saved: %w", mark, DLErr)
+        }
+        if msg.Ack != nil {
+            if ackErr := msg.Ack(); ackErr != nil {
+                srv.log.Error(fmt.Sprintf("%s | Ack failed: %s", mark, ackErr.Error()))
+            }
+        }
+        return err
+    }
+    metrics.MessagesValidated.Inc()
+    nm := srv.Convert(msg.Sequence, &ordModel, &msg.Data)
+    (*nm).Ack = msg.Ack
+    srv.SaveOrder(nm)
+    return nil
+}
+
+func (srv AppStorage) SaveDeadLetter(dl DeadLetter) error {
+    mark := "AppStorage.SaveDeadLetter"
+    // redelivered message is already stored
+    query := `INSERT INTO dead_letters (subject, sequence, msg_timestamp, raw, error)
+        VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (subject, sequence) DO NOTHING`
+
+    var t Token
+    select {
+    case t = <-srv.wPool:
+        defer func(srv AppStorage, t Token) {srv.wPool<- t}(srv, t)
+    case <-srv.ctx.Done():
+        return fmt.Errorf("%s | Error %w", mark, srv.ctx.Err())
+    }
+    Trans, err := srv.db.BeginTx()
+    if err != nil {
+        return classifyDBError(mark, err)
+    }
+    Trans.AddQuery(query, dl.Subject, int64(dl.Sequence), dl.Timestamp, dl.Raw, dl.Error)
+    // dead letter is persisted message too, so checkpoint moves
+    srv.queueCheckpoint(&Trans, dl.Sequence)
+    if err = Trans.RunTx(); err != nil {
+        Trans.Rollback()
+        return classifyDBError(mark, err)
+    }
+    if err = Trans.Commit(); err != nil {
+        return classifyDBError(mark, err)
+    }
+    srv.commitSeq(dl.Sequence)
+    return nil
+}
+
+const deadLetterColumns string = "id, subject, sequence, msg_timestamp, raw, error, created_at, resubmitted_at"
+
+func scanDeadLetter(row pgx.Row) (DeadLetter, error) {
+    var dl DeadLetter
+    var seq int64
+    err := row.Scan(
+        &dl.Id, &dl.Subject, &seq, &dl.Timestamp,
+        &dl.Raw, &dl.Error, &dl.CreatedAt, &dl.ResubmittedAt,
+    )
+    dl.Sequence = uint64(seq)
+    return dl, err
+}
+
+// list dead letters, newest first.
+// after - id of the last item on previous page.
+func (srv AppStorage) ListDeadLetters(after int64, limit int) ([]DeadLetter, error) {
+    mark := "AppStorage.ListDeadLetters"
+    query := "SELECT " + deadLetterColumns + " FROM dead_letters"
+    args := []any{}
+    if after > 0 {
+        query += " WHERE id < $1"
+        args = append(args, after)
+    }
+    args = append(args, limit)
+    query += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d", len(args))
+
+    var t Token
+    select {
+    case t = <-srv.wPool:
+        defer func(srv AppStorage, t Token) {srv.wPool<- t}(srv, t)
+    case <-srv.ctx.Done():
+        return nil, fmt.Errorf("%s | Error %w", mark, srv.ctx.Err())
+    }
+    rows, cancel, err := srv.db.FetchMany(query, args...)
+    if err != nil {
+        return nil, classifyDBError(mark, err)
+    }
+    defer cancel()
+    var letters []DeadLetter
+    for rows.Next() {
+        dl, err := scanDeadLetter(rows)
+        if err != nil {
+            return nil, classifyDBError(mark, err)
+        }
+        letters = append(letters, dl)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, classifyDBError(mark, err)
+    }
+    return letters, nil
+}
+
+func (srv AppStorage) FetchDeadLetter(id int64) (DeadLetter, error) {
+    mark := "AppStorage.FetchDeadLetter"
+    query := "SELECT " + deadLetterColumns + " FROM dead_letters WHERE id = $1"
+
+    var t Token
+    select {
+    case t = <-srv.wPool:
+        defer func(srv AppStorage, t Token) {srv.wPool<- t}(srv, t)
+    case <-srv.ctx.Done():
+        return DeadLetter{}, fmt.Errorf("%s | Error %w", mark, srv.ctx.Err())
+    }
+    rows, cancel, err := srv.db.FetchMany(query, id)
+    if err != nil {
+        return DeadLetter{}, classifyDBError(mark, err)
+    }
+    defer cancel()
+    if !rows.Next() {
+        if err := rows.Err(); err != nil {
+            return DeadLetter{}, classifyDBError(mark, err)
+        }
+        return DeadLetter{}, fmt.Errorf("%s | Id %d: %w", mark, id, DeadLetterNotFound)
+    }
+    dl, err := scanDeadLetter(rows)
+    if err != nil {
+        return DeadLetter{}, classifyDBError(mark, err)
+    }
+    return dl, nil
+}
+
+func (srv AppStorage) markResubmitted(id int64) error {
+    mark := "AppStorage.markResubmitted"
+    query := "UPDATE dead_letters SET resubmitted_at = now() WHERE id = $1"
+    cancel, err := srv.db.Save(query, id)
+    defer cancel()
+    if err != nil {
+        return classifyDBError(mark, err)
+    }
+    return nil
+}
+
+// send fixed message through normal pipeline.
+// If data is empty, stored raw message is used.
+// Dead letter is marked resubmitted after order commit.
+func (srv AppStorage) Resubmit(id int64, data []byte) error {
+    mark := "AppStorage.Resubmit"
+    dl, err := srv.FetchDeadLetter(id)
+    if err != nil {
+        return err
+    }
+    if len(data) == 0 {
+        data = dl.Raw
+    }
+    ordModel, err := DecodeOrder(data)
+    if err != nil {
+        return fmt.Errorf("%s | Id %d: %w", mark, id, err)
+    }
+    // zero msg id: resubmitted message doesn`t move checkpoint
+    nm := srv.Convert(0, &ordModel, &data)
+    (*nm).Ack = func() error {
+        return srv.markResubmitted(id)
+    }
+    srv.SaveOrder(nm)
+    return nil
+}
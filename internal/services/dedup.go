@@ -0,0 +1,105 @@
+package services
+
+import (
+    "fmt"
+    "errors"
+    "sync/atomic"
+
+    "github.com/jackc/pgx/v5"
+)
+
+const (
+    // keep stored order, drop conflicting payload
+    DedupReject string = "reject"
+    // keep stored order, archive conflicting payload in order_versions
+    DedupVersion string = "version"
+)
+
+// counters of redelivered / replayed orders
+type DedupStats struct {
+    duplicates atomic.Int64
+    conflicts atomic.Int64
+    versioned atomic.Int64
+}
+
+// snapshot of DedupStats
+type DedupCounters struct {
+    Duplicates int64
+    Conflicts int64
+    Versioned int64
+}
+
+func (ds *DedupStats) Counters() DedupCounters {
+    return DedupCounters{
+        Duplicates: ds.duplicates.Load(),
+        Conflicts: ds.conflicts.Load(),
+        Versioned: ds.versioned.Load(),
+    }
+}
+
+// check if order already stored and apply dedup policy.
+// Returns nil if order is new.
+func (srv AppStorage) checkStored(nm *NatsMsg) error {
+    mark := "AppStorage.checkStored"
+    // exact bytes, jsonb equality ignores key order and whitespace
+    query := "SELECT raw_payload = $2 FROM orders WHERE oid = $1"
+    var same bool
+    err := srv.db.FetchOne(query, (*nm).Oid, *(*nm).Payload).ParseInto(&same)
+    switch {
+    case errors.Is(err, pgx.ErrNoRows):
+        return nil
+    case err != nil:
+        return err
+    case same:
+        srv.dedup.duplicates.Add(1)
+        return fmt.Errorf("%s | Order [%s] %w", mark, (*nm).Oid, OrderDuplicate)
+    }
+    srv.dedup.conflicts.Add(1)
+    if srv.dedupPolicy != DedupVersion {
+        return fmt.Errorf("%s | Order [%s] %w", mark, (*nm).Oid, OrderConflict)
+    }
+    if err = srv.saveVersion(nm); err != nil {
+        return err
+    }
+    srv.dedup.versioned.Add(1)
+    return fmt.Errorf("%s | Order [%s] %w", mark, (*nm).Oid, OrderVersioned)
+}
+
+// archive conflicting payload as next order version,
+// same payload is never archived twice
+func (srv AppStorage) saveVersion(nm *NatsMsg) error {
+    query := `INSERT INTO order_versions (oid, version, raw_ord, raw_payload)
+        SELECT $1, COALESCE(MAX(version), 1) + 1, $2::jsonb, $3
+        FROM order_versions WHERE oid = $1
+        HAVING NOT EXISTS (
+            SELECT 1 FROM order_versions WHERE oid = $1 AND raw_payload = $3
+        )
+        ON CONFLICT (oid, version) DO NOTHING`
+    cancel, err := srv.db.Save(query, (*nm).Oid, *(*nm).Payload, *(*nm).Payload)
+    defer cancel()
+    return err
+}
+
+// set policy for conflicting payloads with same order_uid
+func (srv *AppStorage) SetDedupPolicy(policy string) error {
+    switch policy {
+    case DedupReject, DedupVersion:
+        (*srv).dedupPolicy = policy
+        return nil
+    case "":
+        (*srv).dedupPolicy = DedupReject
+        return nil
+    }
+    return fmt.Errorf("AppStorage.SetDedupPolicy | Unknown policy: %s", policy)
+}
+
+func (srv AppStorage) DedupStats() DedupCounters {
+    return srv.dedup.Counters()
+}
+
+// order was handled by dedup policy and must not be reported
+func isDeduplicated(err error) bool {
+    return errors.Is(err, OrderDuplicate) ||
+        errors.Is(err, OrderConflict) ||
+        errors.Is(err, OrderVersioned)
+}
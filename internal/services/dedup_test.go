@@ -0,0 +1,72 @@
+package services
+
+import (
+    "errors"
+    "fmt"
+    "testing"
+)
+
+func TestSetDedupPolicy(t *testing.T) {
+    cases := []struct {
+        policy string
+        want string
+        fail bool
+    }{
+        {policy: DedupReject, want: DedupReject},
+        {policy: DedupVersion, want: DedupVersion},
+        {policy: "", want: DedupReject},
+        {policy: "overwrite", fail: true},
+    }
+    for _, tc := range cases {
+        t.Run(tc.policy, func(t *testing.T) {
+            srv := AppStorage{dedupPolicy: DedupVersion}
+            err := srv.SetDedupPolicy(tc.policy)
+            if tc.fail {
+                if err == nil {
+                    t.Fatal("unknown policy accepted")
+                }
+                return
+            }
+            if err != nil || srv.dedupPolicy != tc.want {
+                t.Fatalf("policy %q, error %v", srv.dedupPolicy, err)
+            }
+        })
+    }
+}
+
+// deduplicated orders are acked and not reported
+func TestIsDeduplicated(t *testing.T) {
+    wrap := func(err error) error {
+        return fmt.Errorf("AppStorage.checkStored | Order [o1] %w", err)
+    }
+    cases := []struct {
+        name string
+        err error
+        want bool
+    }{
+        {"nil", nil, false},
+        {"duplicate", wrap(OrderDuplicate), true},
+        {"conflict", wrap(OrderConflict), true},
+        {"versioned", wrap(OrderVersioned), true},
+        {"not found", wrap(OrderNotFound), false},
+        {"db error", errors.New("connection reset"), false},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            if got := isDeduplicated(tc.err); got != tc.want {
+                t.Fatalf("isDeduplicated(%v) = %v", tc.err, got)
+            }
+        })
+    }
+}
+
+func TestDedupCounters(t *testing.T) {
+    srv := AppStorage{dedup: &DedupStats{}}
+    srv.dedup.duplicates.Add(2)
+    srv.dedup.conflicts.Add(1)
+    srv.dedup.versioned.Add(1)
+    want := DedupCounters{Duplicates: 2, Conflicts: 1, Versioned: 1}
+    if got := srv.DedupStats(); got != want {
+        t.Fatalf("got %+v, want %+v", got, want)
+    }
+}
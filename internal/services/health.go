@@ -0,0 +1,111 @@
+package services
+
+import (
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// state of one subsystem for health checks
+type ComponentStatus struct {
+    Ok bool `json:"ok"`
+    Details map[string]any `json:"details,omitempty"`
+    Error string `json:"error,omitempty"`
+}
+
+// storage side state, shared between AppStorage copies
+type storageHealth struct {
+    restoring atomic.Bool
+    restoreDone atomic.Bool
+    // unix nano of last successful cache log sync
+    lastSync atomic.Int64
+}
+
+func (sh *storageHealth) markSynced() {
+    sh.lastSync.Store(time.Now().UnixNano())
+}
+
+// ping db and measure latency
+func (srv AppStorage) DBStatus() ComponentStatus {
+    start := time.Now()
+    err := srv.db.Test()
+    status := ComponentStatus{
+        Ok: err == nil,
+        Details: map[string]any{
+            "latency_ms": float64(time.Since(start).Microseconds()) / 1000,
+        },
+    }
+    if err != nil {
+        status.Error = err.Error()
+    }
+    return status
+}
+
+// not ok while RestoreCache is running
+func (srv AppStorage) CacheStatus() ComponentStatus {
+    restoring := srv.health.restoring.Load()
+    status := ComponentStatus{
+        Ok: !restoring,
+        Details: map[string]any{
+            "restoring": restoring,
+            "restored": srv.health.restoreDone.Load(),
+        },
+    }
+    if restoring {
+        status.Error = "cache restore is running"
+    }
+    return status
+}
+
+// last successful cache log sync, ok if
+// happened not later than maxAge ago
+func (srv AppStorage) SyncStatus(maxAge time.Duration) ComponentStatus {
+    last := srv.health.lastSync.Load()
+    status := ComponentStatus{Ok: true, Details: map[string]any{}}
+    if last == 0 {
+        status.Details["last_sync"] = nil
+        return status
+    }
+    at := time.Unix(0, last)
+    status.Details["last_sync"] = at.Format(time.RFC3339)
+    if maxAge > 0 && time.Since(at) > maxAge {
+        status.Ok = false
+        status.Error = fmt.Sprintf("no successful sync since %s", at.Format(time.RFC3339))
+    }
+    return status
+}
+
+// registry of subsystem checks
+type Health struct {
+    lock sync.RWMutex
+    names []string
+    checks map[string]func() ComponentStatus
+}
+
+func NewHealth() *Health {
+    return &Health{checks: make(map[string]func() ComponentStatus)}
+}
+
+func (h *Health) Register(name string, check func() ComponentStatus) {
+    (*h).lock.Lock()
+    defer (*h).lock.Unlock()
+    if _, ok := (*h).checks[name]; !ok {
+        (*h).names = append((*h).names, name)
+    }
+    (*h).checks[name] = check
+}
+
+// run all checks, ok if every component is ok
+func (h *Health) Check() (bool, map[string]ComponentStatus) {
+    (*h).lock.RLock()
+    defer (*h).lock.RUnlock()
+    ok := true
+    report := make(map[string]ComponentStatus, len((*h).names))
+    for _, name := range (*h).names {
+        status := (*h).checks[name]()
+        ok = ok && status.Ok
+        report[name] = status
+    }
+    return ok, report
+}
@@ -0,0 +1,92 @@
+package services
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "strings"
+    "time"
+)
+
+const (
+    // rows fetched from cursor at once
+    exportBatch int = 500
+    // exports hold db connection for long time
+    defaultMaxExports int = 2
+)
+
+var (
+    ExportBusy = errors.New("Too many exports in progress")
+)
+
+// exports running at once, each holds db connection
+// until client reads all rows
+func (srv *AppStorage) SetExportLimit(n int) {
+    if n <= 0 {
+        n = defaultMaxExports
+    }
+    (*srv).exports = make(chan struct{}, n)
+}
+
+// date range for export, zero bound is open
+type ExportFilter struct {
+    From time.Time
+    To time.Time
+}
+
+func (f ExportFilter) build() (string, []any) {
+    var conds []string
+    var args []any
+    if !f.From.IsZero() {
+        args = append(args, f.From)
+        conds = append(conds, fmt.Sprintf("date_created >= $%d", len(args)))
+    }
+    if !f.To.IsZero() {
+        args = append(args, f.To)
+        conds = append(conds, fmt.Sprintf("date_created < $%d", len(args)))
+    }
+    query := "SELECT raw_payload FROM orders"
+    if len(conds) > 0 {
+        query += " WHERE " + strings.Join(conds, " AND ")
+    }
+    return query + " ORDER BY date_created, seq_idx", args
+}
+
+// stream raw payloads of orders in date range into fn,
+// rows are read by server-side cursor batches.
+// FetchMany is not used: it runs plain pool Query under db timeout,
+// pgx reads whole result through one connection and slow client
+// would hit timeout. Cursor lives in own transaction, bound to
+// request ctx, only one batch is in memory.
+func (srv AppStorage) ExportOrders(ctx context.Context, f ExportFilter, fn func(raw []byte) error) error {
+    mark := "AppStorage.ExportOrders"
+    select {
+    case srv.exports<- struct{}{}:
+        defer func() {<-srv.exports}()
+    default:
+        return ExportBusy
+    }
+    query, args := f.build()
+    cur, err := srv.db.FetchCursor(ctx, exportBatch, query, args...)
+    if err != nil {
+        return classifyDBError(mark, err)
+    }
+    defer cur.Close()
+    var raw []byte
+    for cur.Next() {
+        if err = cur.Scan(&raw); err != nil {
+            return fmt.Errorf("%s | Error %w", mark, err)
+        }
+        if err = fn(raw); err != nil {
+            return err
+        }
+    }
+    if err = cur.Err(); err != nil {
+        if ctx.Err() != nil {
+            // client gone
+            return ctx.Err()
+        }
+        return classifyDBError(mark, err)
+    }
+    return nil
+}
@@ -0,0 +1,73 @@
+package services
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+func TestExportFilterBuild(t *testing.T) {
+    from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+    to := from.AddDate(0, 1, 0)
+    order := " ORDER BY date_created, seq_idx"
+    cases := []struct {
+        name string
+        filter ExportFilter
+        query string
+        args []any
+    }{
+        {
+            name: "open range",
+            query: "SELECT raw_payload FROM orders" + order,
+        },
+        {
+            name: "from",
+            filter: ExportFilter{From: from},
+            query: "SELECT raw_payload FROM orders WHERE date_created >= $1" + order,
+            args: []any{from},
+        },
+        {
+            name: "to",
+            filter: ExportFilter{To: to},
+            query: "SELECT raw_payload FROM orders WHERE date_created < $1" + order,
+            args: []any{to},
+        },
+        {
+            name: "both",
+            filter: ExportFilter{From: from, To: to},
+            query: "SELECT raw_payload FROM orders WHERE date_created >= $1 AND date_created < $2" + order,
+            args: []any{from, to},
+        },
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            query, args := tc.filter.build()
+            if query != tc.query {
+                t.Fatalf("query %q, want %q", query, tc.query)
+            }
+            if len(args) != len(tc.args) {
+                t.Fatalf("args %v, want %v", args, tc.args)
+            }
+            for i := range args {
+                if args[i] != tc.args[i] {
+                    t.Fatalf("args %v, want %v", args, tc.args)
+                }
+            }
+        })
+    }
+}
+
+func TestExportLimit(t *testing.T) {
+    srv := AppStorage{}
+    srv.SetExportLimit(1)
+    // slot is taken by running export
+    srv.exports<- struct{}{}
+    err := srv.ExportOrders(context.Background(), ExportFilter{}, func([]byte) error {return nil})
+    if err != ExportBusy {
+        t.Fatalf("want ExportBusy, got %v", err)
+    }
+    srv.SetExportLimit(0)
+    if cap(srv.exports) != defaultMaxExports {
+        t.Fatalf("default limit %d", cap(srv.exports))
+    }
+}
@@ -0,0 +1,182 @@
+package services
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "sync"
+
+    "nats_app/internal/metrics"
+    "nats_app/internal/storage"
+)
+
+const (
+    defaultFeedBuffer int = 64
+)
+
+var (
+    FeedFull = errors.New("Too many feed subscribers")
+    FeedClosed = errors.New("Order feed is closed")
+    FeedSlowConsumer = errors.New("Subscriber doesn`t read feed in time")
+)
+
+// newly persisted order, payload is compact json
+type FeedEvent struct {
+    Oid string
+    DeliveryServ string
+    CustomerId string
+    Payload []byte
+}
+
+// empty field matches any value
+type FeedFilter struct {
+    DeliveryServ string
+    CustomerId string
+}
+
+func (f FeedFilter) match(ev *FeedEvent) bool {
+    if f.DeliveryServ != "" && f.DeliveryServ != (*ev).DeliveryServ {
+        return false
+    }
+    if f.CustomerId != "" && f.CustomerId != (*ev).CustomerId {
+        return false
+    }
+    return true
+}
+
+type FeedSubscriber struct {
+    filter FeedFilter
+    events chan FeedEvent
+    done chan struct{}
+    // why subscriber was dropped, set before done is closed
+    reason error
+}
+
+func (fs *FeedSubscriber) Events() <-chan FeedEvent {
+    return (*fs).events
+}
+
+// closed when feed drops subscriber
+func (fs *FeedSubscriber) Done() <-chan struct{} {
+    return (*fs).done
+}
+
+func (fs *FeedSubscriber) Err() error {
+    select {
+    case <-(*fs).done:
+        return (*fs).reason
+    default:
+        return nil
+    }
+}
+
+// fan-out of saved orders to live subscribers, at most once:
+// events are not stored, reconnected client gets only new ones.
+// Publish never blocks: subscriber with full buffer is dropped.
+type OrderFeed struct {
+    mu sync.Mutex
+    subs map[*FeedSubscriber]struct{}
+    buffer int
+    // 0 - no limit
+    maxSubs int
+    closed bool
+}
+
+func NewOrderFeed(buffer int, maxSubs int) *OrderFeed {
+    if buffer <= 0 {
+        buffer = defaultFeedBuffer
+    }
+    return &OrderFeed{
+        subs: make(map[*FeedSubscriber]struct{}),
+        buffer: buffer,
+        maxSubs: maxSubs,
+    }
+}
+
+func (of *OrderFeed) Subscribe(f FeedFilter) (*FeedSubscriber, error) {
+    (*of).mu.Lock()
+    defer (*of).mu.Unlock()
+    if (*of).closed {
+        return nil, FeedClosed
+    }
+    if (*of).maxSubs > 0 && len((*of).subs) >= (*of).maxSubs {
+        return nil, FeedFull
+    }
+    sub := &FeedSubscriber{
+        filter: f,
+        events: make(chan FeedEvent, (*of).buffer),
+        done: make(chan struct{}),
+    }
+    (*of).subs[sub] = struct{}{}
+    return sub, nil
+}
+
+// client gone, safe to call after subscriber was dropped
+func (of *OrderFeed) Unsubscribe(sub *FeedSubscriber) {
+    (*of).mu.Lock()
+    defer (*of).mu.Unlock()
+    delete((*of).subs, sub)
+}
+
+// must be called under lock
+func (of *OrderFeed) drop(sub *FeedSubscriber, reason error) {
+    delete((*of).subs, sub)
+    (*sub).reason = reason
+    close((*sub).done)
+}
+
+func (of *OrderFeed) Publish(ev FeedEvent) {
+    (*of).mu.Lock()
+    defer (*of).mu.Unlock()
+    if (*of).closed || len((*of).subs) == 0 {
+        return
+    }
+    for sub := range (*of).subs {
+        if !(*sub).filter.match(&ev) {
+            continue
+        }
+        select {
+        case (*sub).events<- ev:
+        default:
+            metrics.FeedDisconnects.WithLabelValues("slow").Inc()
+            (*of).drop(sub, FeedSlowConsumer)
+        }
+    }
+}
+
+// publish saved order, payload newlines are removed
+// so event fits into one SSE data line
+func (of *OrderFeed) PublishOrder(m *storage.CustomerOrder, raw []byte) error {
+    var payload bytes.Buffer
+    if err := json.Compact(&payload, raw); err != nil {
+        return err
+    }
+    (*of).Publish(FeedEvent{
+        Oid: (*m).Order_id,
+        DeliveryServ: (*m).DeliveryServ,
+        CustomerId: (*m).CustomerId,
+        Payload: payload.Bytes(),
+    })
+    return nil
+}
+
+func (of *OrderFeed) Subscribers() int {
+    (*of).mu.Lock()
+    defer (*of).mu.Unlock()
+    return len((*of).subs)
+}
+
+// drop all subscribers, streaming handlers return
+// and http server can shut down
+func (of *OrderFeed) Close() {
+    (*of).mu.Lock()
+    defer (*of).mu.Unlock()
+    if (*of).closed {
+        return
+    }
+    (*of).closed = true
+    for sub := range (*of).subs {
+        metrics.FeedDisconnects.WithLabelValues("closed").Inc()
+        (*of).drop(sub, FeedClosed)
+    }
+}
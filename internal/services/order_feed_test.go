@@ -0,0 +1,132 @@
+package services
+
+import (
+    "errors"
+    "testing"
+
+    "nats_app/internal/storage"
+)
+
+func TestFeedFilterMatch(t *testing.T) {
+    ev := FeedEvent{Oid: "o1", DeliveryServ: "meest", CustomerId: "c1"}
+    cases := []struct {
+        name string
+        filter FeedFilter
+        want bool
+    }{
+        {"empty matches any", FeedFilter{}, true},
+        {"delivery service", FeedFilter{DeliveryServ: "meest"}, true},
+        {"other delivery service", FeedFilter{DeliveryServ: "dhl"}, false},
+        {"customer", FeedFilter{CustomerId: "c1"}, true},
+        {"other customer", FeedFilter{CustomerId: "c2"}, false},
+        {"both", FeedFilter{DeliveryServ: "meest", CustomerId: "c1"}, true},
+        {"one of both differs", FeedFilter{DeliveryServ: "meest", CustomerId: "c2"}, false},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            if got := tc.filter.match(&ev); got != tc.want {
+                t.Fatalf("match %+v: %v, want %v", tc.filter, got, tc.want)
+            }
+        })
+    }
+}
+
+func TestFeedPublishFiltered(t *testing.T) {
+    feed := NewOrderFeed(4, 0)
+    all, _ := feed.Subscribe(FeedFilter{})
+    meest, _ := feed.Subscribe(FeedFilter{DeliveryServ: "meest"})
+    feed.Publish(FeedEvent{Oid: "o1", DeliveryServ: "meest"})
+    feed.Publish(FeedEvent{Oid: "o2", DeliveryServ: "dhl"})
+    if len(all.Events()) != 2 || len(meest.Events()) != 1 {
+        t.Fatalf("all got %d, meest got %d", len(all.Events()), len(meest.Events()))
+    }
+    if ev := <-meest.Events(); ev.Oid != "o1" {
+        t.Fatalf("meest got %s", ev.Oid)
+    }
+}
+
+// publisher never waits for subscriber, full buffer drops it
+func TestFeedSlowConsumer(t *testing.T) {
+    feed := NewOrderFeed(2, 0)
+    slow, _ := feed.Subscribe(FeedFilter{})
+    // filtered out events don`t fill buffer
+    other, _ := feed.Subscribe(FeedFilter{CustomerId: "c2"})
+    for i := 0; i < 3; i++ {
+        feed.Publish(FeedEvent{CustomerId: "c1"})
+    }
+    select {
+    case <-slow.Done():
+    default:
+        t.Fatal("slow subscriber is not dropped")
+    }
+    if !errors.Is(slow.Err(), FeedSlowConsumer) {
+        t.Fatalf("reason %v", slow.Err())
+    }
+    if other.Err() != nil || feed.Subscribers() != 1 {
+        t.Fatalf("other: %v, subscribers %d", other.Err(), feed.Subscribers())
+    }
+    // events already buffered are still readable
+    if len(slow.Events()) != 2 {
+        t.Fatalf("buffered %d", len(slow.Events()))
+    }
+    // handler unsubscribes after drop
+    feed.Unsubscribe(slow)
+    if feed.Subscribers() != 1 {
+        t.Fatalf("subscribers %d", feed.Subscribers())
+    }
+}
+
+func TestFeedMaxSubscribers(t *testing.T) {
+    feed := NewOrderFeed(1, 1)
+    first, err := feed.Subscribe(FeedFilter{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err = feed.Subscribe(FeedFilter{}); !errors.Is(err, FeedFull) {
+        t.Fatalf("want FeedFull, got %v", err)
+    }
+    feed.Unsubscribe(first)
+    if _, err = feed.Subscribe(FeedFilter{}); err != nil {
+        t.Fatalf("slot is not released: %v", err)
+    }
+}
+
+func TestFeedClose(t *testing.T) {
+    feed := NewOrderFeed(1, 0)
+    sub, _ := feed.Subscribe(FeedFilter{})
+    feed.Close()
+    feed.Close()
+    select {
+    case <-sub.Done():
+    default:
+        t.Fatal("subscriber is not dropped on close")
+    }
+    if !errors.Is(sub.Err(), FeedClosed) {
+        t.Fatalf("reason %v", sub.Err())
+    }
+    if _, err := feed.Subscribe(FeedFilter{}); !errors.Is(err, FeedClosed) {
+        t.Fatalf("want FeedClosed, got %v", err)
+    }
+    // no panic on closed feed
+    feed.Publish(FeedEvent{})
+}
+
+func TestFeedPublishOrder(t *testing.T) {
+    feed := NewOrderFeed(1, 0)
+    sub, _ := feed.Subscribe(FeedFilter{})
+    m := storage.CustomerOrder{Order_id: "o1", DeliveryServ: "meest", CustomerId: "c1"}
+    if err := feed.PublishOrder(&m, []byte("{\n  \"order_uid\": \"o1\"\n}")); err != nil {
+        t.Fatal(err)
+    }
+    ev := <-sub.Events()
+    if ev.Oid != "o1" || ev.DeliveryServ != "meest" || ev.CustomerId != "c1" {
+        t.Fatalf("event %+v", ev)
+    }
+    // one SSE data line
+    if string(ev.Payload) != `{"order_uid":"o1"}` {
+        t.Fatalf("payload %s", ev.Payload)
+    }
+    if err := feed.PublishOrder(&m, []byte("{")); err == nil {
+        t.Fatal("broken json published")
+    }
+}
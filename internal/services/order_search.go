@@ -0,0 +1,90 @@
+package services
+
+import (
+    "fmt"
+    "time"
+    "strings"
+)
+
+const (
+    DefaultPageLimit int = 50
+    MaxPageLimit int = 500
+)
+
+// filters for orders search, empty fields are ignored
+type OrderFilter struct {
+    CustomerId string
+    TrackNumber string
+    DeliveryService string
+    Locale string
+    // payment transaction
+    Transaction string
+    CreatedFrom time.Time
+    CreatedTo time.Time
+    // seq_idx of the last order on previous page,
+    // 0 means start from the newest one
+    After int64
+    Limit int
+}
+
+// one page of search result
+type OrdersPage struct {
+    Items []Order
+    // seq_idx of the last item, use it as
+    // OrderFilter.After to fetch next page
+    Last int64
+    HasMore bool
+}
+
+func (f OrderFilter) limit() int {
+    if f.Limit <= 0 {
+        return DefaultPageLimit
+    }
+    if f.Limit > MaxPageLimit {
+        return MaxPageLimit
+    }
+    return f.Limit
+}
+
+// build query with positional args over extracted
+// columns, ordered by seq_idx (keyset pagination)
+func (f OrderFilter) build() (string, []any) {
+    var conds []string
+    var args []any
+    add := func(cond string, arg any) {
+        args = append(args, arg)
+        conds = append(conds, fmt.Sprintf(cond, len(args)))
+    }
+    if f.CustomerId != "" {
+        add("customer_id = $%d", f.CustomerId)
+    }
+    if f.TrackNumber != "" {
+        add("track_number = $%d", f.TrackNumber)
+    }
+    if f.DeliveryService != "" {
+        add("delivery_service = $%d", f.DeliveryService)
+    }
+    if f.Locale != "" {
+        add("locale = $%d", f.Locale)
+    }
+    if f.Transaction != "" {
+        add("EXISTS (SELECT 1 FROM payments p WHERE p.oid = orders.oid AND p.transaction = $%d)", f.Transaction)
+    }
+    if !f.CreatedFrom.IsZero() {
+        add("date_created >= $%d", f.CreatedFrom)
+    }
+    if !f.CreatedTo.IsZero() {
+        add("date_created < $%d", f.CreatedTo)
+    }
+    if f.After > 0 {
+        add("seq_idx < $%d", f.After)
+    }
+    query := "SELECT seq_idx, oid, raw_payload FROM orders"
+    if len(conds) > 0 {
+        query += " WHERE " + strings.Join(conds, " AND ")
+    }
+    // fetch one extra row to know if next page exists
+    args = append(args, f.limit() + 1)
+    query += fmt.Sprintf(" ORDER BY seq_idx DESC LIMIT $%d", len(args))
+    return query, args
+}
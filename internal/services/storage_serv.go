@@ -2,13 +2,14 @@ package services
 
 import (
     "fmt"
+    "errors"
     "log/slog"
     "context"
     "time"
     "os"
+    "sync"
 
-    "github.com/jackc/pgx/v5"
-
+    "nats_app/internal/metrics"
     "nats_app/internal/storage"
     "nats_app/internal/storage/psql"
 )
@@ -34,6 +35,18 @@ func (ords *Orders) GetItems() []Order {
 type NatsMsg struct {
     MsgId uint64
     Order
+    // decoded and validated payload
+    Model *storage.CustomerOrder
+    // confirm message to broker, called only
+    // after order was committed and cache fed
+    Ack func() error
+}
+
+func (nm *NatsMsg) acknowledge() error {
+    if (*nm).Ack == nil {
+        return nil
+    }
+    return (*nm).Ack()
 }
 
 type CacheItem struct {
@@ -69,7 +82,7 @@ type StorageInterface interface {
     SaveOrder(mn interface{})
     Convert() interface{}
     FetchOrder(oid string) (interface{}, error)
-    MarkDumped(<-chan interface{})
+    MarkDumped(<-chan interface{}) bool
 }
 
 type AppStorage struct {
@@ -79,6 +92,20 @@ type AppStorage struct {
     wPool chan Token
     outCh chan CacheItem
     errCh chan<- error
+    dedup *DedupStats
+    dedupPolicy string
+    // durable name for checkpoints
+    checkpoint string
+    seqs *seqWatermark
+    // owner of cache eviction state
+    instance string
+    // SaveOrder goroutines in flight
+    inflight *intake
+    health *storageHealth
+    // live subscribers of saved orders, nil - disabled
+    feed *OrderFeed
+    // slots of running exports
+    exports chan struct{}
 }
 
 // biuld new AppStorage
@@ -100,6 +127,12 @@ func NewStorage(
         wPool:          wpool,
         outCh:          outCh,
         errCh:          errch,
+        dedup:          &DedupStats{},
+        seqs:           newSeqWatermark(),
+        inflight:       &intake{},
+        health:         &storageHealth{},
+        dedupPolicy:    DedupReject,
+        exports:        make(chan struct{}, defaultMaxExports),
         log:            *slog.New(
                             slog.NewTextHandler(
                                  os.Stdout,
@@ -113,83 +146,199 @@ func (srv AppStorage) SetLogger(l slog.Logger) {
     srv.log.Debug("AppStorage logger setup...")
 }
 
+// cache eviction state is stored per instance
+func (srv *AppStorage) SetInstanceId(id string) {
+    (*srv).instance = id
+}
+
+// saved orders are published into feed
+func (srv *AppStorage) SetFeed(f *OrderFeed) {
+    (*srv).feed = f
+}
+
 // return channel for items that will 
 // fetch data from db
 func (srv AppStorage) GetChannel() <-chan CacheItem {
     return srv.outCh
 }
 
+// counts SaveOrder goroutines, once closed
+// no new ones are started, so Wait never races with Add
+type intake struct {
+    mu sync.Mutex
+    closed bool
+    wg sync.WaitGroup
+}
+
+// false - intake is closed
+func (in *intake) add() bool {
+    (*in).mu.Lock()
+    defer (*in).mu.Unlock()
+    if (*in).closed {
+        return false
+    }
+    (*in).wg.Add(1)
+    return true
+}
+
+func (in *intake) done() {
+    (*in).wg.Done()
+}
+
+// stop intake and wait for goroutines in flight
+func (in *intake) wait() {
+    (*in).mu.Lock()
+    (*in).closed = true
+    (*in).mu.Unlock()
+    (*in).wg.Wait()
+}
+
+// stop accepting orders and wait for SaveOrder goroutines
+// in flight, false if timeout expired first.
+// Orders after Wait are not acked and will be redelivered.
+func (srv AppStorage) Wait(timeout time.Duration) bool {
+    done := make(chan struct{})
+    go func() {
+        srv.inflight.wait()
+        close(done)
+    }()
+    select {
+    case <-done:
+        return true
+    case <-time.After(timeout):
+        return false
+    }
+}
+
+// pool tokens taken by running db operations
+func (srv AppStorage) PoolInUse() int {
+    return cap(srv.wPool) - len(srv.wPool)
+}
+
+// drop broken connections and check db again
+func (srv AppStorage) Reconnect() error {
+    srv.db.Reset()
+    _, err := srv.TestConnection()
+    return err
+}
+
 // break connection with db
 func (srv AppStorage) Disconnect() {
     srv.db.Disconnect()
 }
 
-// restore cache if we felt down
-func (srv AppStorage) RestoreCache(records int, timeout time.Duration) func() {
+// take over cache state stored before upgrade to per instance
+// state (it has empty instance_id), only first instance gets it.
+// Returns number of claimed keys.
+func (srv AppStorage) ClaimCacheState() (int64, error) {
+    mark := "AppStorage.ClaimCacheState"
+    query := `WITH legacy AS (
+            DELETE FROM order_cache_state WHERE instance_id = ''
+            RETURNING oid, evict, updated_at
+        ), claimed AS (
+            INSERT INTO order_cache_state (instance_id, oid, evict, updated_at)
+            SELECT $1, oid, evict, updated_at FROM legacy
+            ON CONFLICT (instance_id, oid) DO NOTHING
+            RETURNING 1
+        )
+        SELECT count(*) FROM claimed`
+    var claimed int64
+    if err := srv.db.FetchOne(query, srv.instance).ParseInto(&claimed); err != nil {
+        return 0, classifyDBError(mark, err)
+    }
+    return claimed, nil
+}
+
+// restore cache if we felt down: keys that were resident
+// (marked Added by MarkDumped) for this instance.
+// present - keys already loaded (from snapshot), db is asked
+// only for missing ones, up to records in total.
+func (srv AppStorage) RestoreCache(records int, timeout time.Duration, present []string) func() {
     //...
     mark := "AppStorage.RestoreCache"
     tmpCtx, cancel := context.WithTimeout(srv.ctx, timeout)
 
     srv.log.Debug(mark)
+    srv.health.restoring.Store(true)
     go func(s AppStorage, ctx context.Context, limit int) {
 
-        var t Token
-        defer func(srv AppStorage, t Token) {s.wPool<- t}(s, t)
+        defer s.health.restoring.Store(false)
+        if present == nil {
+            // NULL array would exclude everything
+            present = []string{}
+        }
         var offset int
-        var orders []Order
-        var cancel func()
-        query := "SELECT oid, raw_ord FROM orders WHERE evict=$1 ORDER BY seq_idx DESC LIMIT $2 OFFSET $3"
-        batch := int(limit / 10)
-        for i := 0; i < 10; i++ {
+        query := `SELECT o.oid, o.raw_payload FROM orders o
+            JOIN order_cache_state c ON c.oid = o.oid AND c.instance_id = $1
+            WHERE c.evict = $2 AND o.oid <> ALL($5)
+            ORDER BY o.seq_idx DESC LIMIT $3 OFFSET $4`
+        batch := limit / 10
+        if batch <= 0 {
+            batch = limit
+        }
+        for offset < limit {
+            if offset + batch > limit {
+                batch = limit - offset
+            }
+            var t Token
             select {
             case <-ctx.Done():
                 return
             case t = <-s.wPool:
-                rows, cancel, err := s.db.FetchMany(query, Evicted, batch, offset)
-                if err != nil {
-                    cancel()
-                    select {
-                    case <-ctx.Done():
-                        return
-                    case s.errCh<- err:
-                        return
-                    }
-                }
-                Rows := rows.(pgx.Rows)
-                for Rows.Next() {
-                    var ord Order
-                    if err := Rows.Scan(&ord.Oid, &ord.Payload); err != nil {
-                        s.log.Error(fmt.Sprintf("Can`t parse data... | %+v", err))
-                        continue
-                    }
-                    orders = append(orders, ord)
-                }
-                offset += batch
-                ords := Orders{items: orders}
-                cItem := CacheItem{kind: AddMany, payload: ords}
+            }
+            orders, err := s.fetchBatch(query, s.instance, Added, batch, offset, present)
+            // we return token each iteration
+            s.wPool<- t
+            if err != nil {
                 select {
                 case <-ctx.Done():
-                    cancel()
-                    return
-                case s.outCh<- cItem:
-                    orders = nil
+                case s.errCh<- fmt.Errorf("%s | Error %w", mark, err):
                 }
+                return
             }
-            // we return tokem each iteration
+            offset += batch
+            if len(orders) == 0 {
+                break
+            }
+            ords := Orders{items: orders}
+            cItem := CacheItem{kind: AddMany, payload: ords}
             select {
-            case s.wPool<- t:
             case <-ctx.Done():
-                cancel()
                 return
+            case s.outCh<- cItem:
+            }
+            if len(orders) < batch {
+                // nothing more in db
+                break
             }
         }
 
+        s.health.restoreDone.Store(true)
         s.log.Debug("Cache restoration finished...")
-    }(srv, tmpCtx, records)
+    }(srv, tmpCtx, records - len(present))
 
     return cancel
 }
 
+// read oid, raw_payload rows into orders
+func (srv AppStorage) fetchBatch(query string, args ...any) ([]Order, error) {
+    var orders []Order
+    rows, cancel, err := srv.db.FetchMany(query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer cancel()
+    for rows.Next() {
+        var ord Order
+        if err := rows.Scan(&ord.Oid, &ord.Payload); err != nil {
+            srv.log.Error(fmt.Sprintf("Can`t parse data... | %+v", err))
+            continue
+        }
+        orders = append(orders, ord)
+    }
+    return orders, rows.Err()
+}
+
 func (srv AppStorage) TestConnection() (bool, error) {
     //...
     srv.log.Debug("Ping DB...")
@@ -202,89 +351,239 @@ func (srv AppStorage) TestConnection() (bool, error) {
     return false, nil
 }
 
-func (srv AppStorage) Convert(id uint64, oid string, data *[]byte) *NatsMsg {
-    o := Order{oid, data}
-    return &NatsMsg{id, o}
+func (srv AppStorage) Convert(id uint64, model *storage.CustomerOrder, data *[]byte) *NatsMsg {
+    o := Order{(*model).Order_id, data}
+    return &NatsMsg{MsgId: id, Order: o, Model: model}
+}
+
+const (
+    insertOrderQuery string = `INSERT INTO orders (
+        oid, raw_ord, raw_payload, track_number, entry, locale, internal_signature,
+        customer_id, delivery_service, shardkey, sm_id, date_created, oof_shard
+    ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`
+    insertDeliveryQuery string = `INSERT INTO deliveries (
+        oid, name, phone, zip, city, address, region, email
+    ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+    insertPaymentQuery string = `INSERT INTO payments (
+        oid, transaction, request_id, currency, provider, amount, payment_dt,
+        bank, delivery_cost, goods_total, custom_fee
+    ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+    insertItemQuery string = `INSERT INTO order_items (
+        oid, chrt_id, track_number, price, rid, name, sale, size,
+        total_price, nm_id, brand, status
+    ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
+)
+
+// queue inserts of decoded order into normalized tables.
+// Exact payload bytes are kept in orders.raw_payload for replay,
+// raw_ord is jsonb copy for queries.
+func queueOrderInserts(tr *psql.Transaction, m *storage.CustomerOrder, raw []byte) {
+    oid := (*m).Order_id
+    tr.AddQuery(
+        insertOrderQuery,
+        oid, raw, raw, m.Track_numb, m.Entry, m.Locale, m.IntSing,
+        m.CustomerId, m.DeliveryServ, m.Shardkey, m.SmId, m.DateCreated, m.OofShard,
+    )
+    d := (*m).Delivery
+    tr.AddQuery(
+        insertDeliveryQuery,
+        oid, d.Name, d.Phone, d.Zip, d.City, d.Address, d.Region, d.Email,
+    )
+    p := (*m).Payment
+    tr.AddQuery(
+        insertPaymentQuery,
+        oid, p.Trans, p.ReqId, p.Currency, p.Provider, p.Amount, p.PaymentDt,
+        p.Bank, p.DelivCost, p.GoodsTotal, p.CustomsFee,
+    )
+    for _, it := range (*m).Items {
+        tr.AddQuery(
+            insertItemQuery,
+            oid, it.ChrtId, it.TrNumber, it.Price, it.Rid, it.Name, it.Sale, it.Size,
+            it.TotalPrice, it.NmId, it.Brand, it.Status,
+        )
+    }
 }
 
 func (srv AppStorage) SaveOrder(nm *NatsMsg) {
-    
-    o := Order{Oid: (*nm).Oid, Payload: nm.Payload}
-    query := "INSERT INTO orders (oid, raw_ord) VALUES ($1, $2)"
 
-    go func(s AppStorage, query *string, o *Order) {
+    if !srv.inflight.add() {
+        // shutting down, not acked message will be redelivered
+        srv.log.Debug(fmt.Sprintf("AppStorage.SaveOrder | Intake closed, MsgNum [%d] skipped...", (*nm).MsgId))
+        return
+    }
+    go func(s AppStorage, nm *NatsMsg) {
         var t Token
         mark := "AppStorage.SaveOrder"
-        defer func(srv AppStorage, t Token) {s.wPool<- t}(s, t)
+        defer s.inflight.done()
+        start := time.Now()
         select {
         case t = <-s.wPool:
-            Cancel, DBErr := s.db.Save(*query, o.Oid, *o.Payload)
-            if DBErr != nil {
-                Cancel()
-                DBErr = fmt.Errorf("%s: %w", mark, DBErr)
-                errText := fmt.Sprintf("%s [GORO] | Error %s", mark, DBErr.Error())
-                s.log.Error(errText)
-                select {
-                case s.errCh<- DBErr:
-                    return
-                }
+            defer func(s AppStorage, t Token) {s.wPool<- t}(s, t)
+        case <-s.ctx.Done():
+            return
+        }
+        DBErr := s.saveInTx(nm)
+        metrics.SaveOrderDuration.Observe(time.Since(start).Seconds())
+        if isDeduplicated(DBErr) {
+            // redelivered or replayed message, nothing to report
+            if errors.Is(DBErr, OrderConflict) {
+                s.log.Warn(fmt.Sprintf("%s | Rejected: %s", mark, DBErr.Error()))
+            } else {
+                s.log.Debug(fmt.Sprintf("%s | Skipped: %s", mark, DBErr.Error()))
             }
-            cItem := CacheItem{AddOne, *o}
+            s.ack(nm, mark)
+            s.commitSeq((*nm).MsgId)
+            return
+        }
+        if DBErr != nil {
+            metrics.SaveOrderFailures.Inc()
+            DBErr = classifyDBError(mark, DBErr)
+            errText := fmt.Sprintf("%s [GORO] | Error %s", mark, DBErr.Error())
+            s.log.Error(errText)
             select {
+            case s.errCh<- DBErr:
             case <-s.ctx.Done():
-            case s.outCh<- cItem:
             }
+            return
+        }
+        cItem := CacheItem{AddOne, (*nm).Order}
+        select {
         case <-s.ctx.Done():
+            // not acked, will be redelivered
+            return
+        case s.outCh<- cItem:
+        }
+        if s.feed != nil && (*nm).Model != nil {
+            if err := s.feed.PublishOrder((*nm).Model, *(*nm).Payload); err != nil {
+                s.log.Warn(fmt.Sprintf("%s | Not published into feed: %s", mark, err.Error()))
+            }
         }
+        s.ack(nm, mark)
+        s.commitSeq((*nm).MsgId)
         return
-    }(srv, &query, &o)
+    }(srv, nm)
 
     return
 }
 
-func (srv AppStorage) FetchOrder(oid string) Order {
+func (srv AppStorage) ack(nm *NatsMsg, mark string) {
+    if err := nm.acknowledge(); err != nil {
+        srv.log.Error(fmt.Sprintf("%s | Ack failed, msg_id %d: %s", mark, (*nm).MsgId, err.Error()))
+    }
+}
+
+// write order into all tables in one transaction.
+// Already stored orders are resolved by dedup policy.
+func (srv AppStorage) saveInTx(nm *NatsMsg) error {
+    if err := srv.checkStored(nm); err != nil {
+        return err
+    }
+    Trans, TrError := srv.db.BeginTx()
+    if TrError != nil {
+        return TrError
+    }
+    queueOrderInserts(&Trans, (*nm).Model, *(*nm).Payload)
+    srv.queueCheckpoint(&Trans, (*nm).MsgId)
+    if TrError = Trans.RunTx(); TrError != nil {
+        Trans.Rollback()
+        if isUniqueViolation(TrError) {
+            // same order was inserted concurrently
+            return srv.checkStored(nm)
+        }
+        return TrError
+    }
+    return Trans.Commit()
+}
+
+// fetch order by id. Returns OrderNotFound if no same order,
+// *DBTimeout or *DBConnectionLost if db failed.
+func (srv AppStorage) FetchOrder(oid string) (Order, error) {
     // make query
 
-    query := "SELECT oid, raw_ord FROM orders WHERE oid=$1"
+    query := "SELECT oid, raw_payload FROM orders WHERE oid=$1"
     mark := "AppStorage.FetchOrder"
 
     var t Token
     var ord Order
-    defer func(srv AppStorage, t Token) {srv.wPool<- t}(srv, t)
     select {
     case t = <-srv.wPool:
-        fetched := srv.db.FetchOne(query, oid)
-        DBErr := fetched.ParseInto(&ord.Oid, &ord.Payload)
-        if DBErr != nil {
-            DBErr = fmt.Errorf("%s: %w", mark, DBErr)
-            srv.log.Debug(fmt.Sprintf("Error... %s", DBErr.Error()))
-            select {
-            case srv.errCh<- DBErr:
-            case <-srv.ctx.Done():
-            }
+        defer func(srv AppStorage, t Token) {srv.wPool<- t}(srv, t)
+    case <-srv.ctx.Done():
+        return Order{}, fmt.Errorf("%s | Error %w", mark, srv.ctx.Err())
+    }
+    fetched := srv.db.FetchOne(query, oid)
+    DBErr := fetched.ParseInto(&ord.Oid, &ord.Payload)
+    if DBErr != nil {
+        DBErr = classifyDBError(mark, DBErr)
+        if errors.Is(DBErr, OrderNotFound) {
+            srv.log.Debug(fmt.Sprintf("%s | Order [%s] not found", mark, oid))
+            return Order{}, DBErr
         }
+        srv.log.Error(fmt.Sprintf("%s | Error... %s", mark, DBErr.Error()))
+        // only db failures are reported to main loop
+        select {
+        case srv.errCh<- DBErr:
+        case <-srv.ctx.Done():
+        }
+        return Order{}, DBErr
     }
     srv.log.Debug(fmt.Sprintf("%s | Order [%s] found", mark, oid))
-    return ord
+    return ord, nil
+}
+
+// fetch many orders with one query, missing ids are skipped
+func (srv AppStorage) FetchOrders(oids []string) ([]Order, error) {
+    query := "SELECT oid, raw_payload FROM orders WHERE oid = ANY($1)"
+    mark := "AppStorage.FetchOrders"
+
+    if len(oids) == 0 {
+        return nil, nil
+    }
+    var t Token
+    select {
+    case t = <-srv.wPool:
+        defer func(srv AppStorage, t Token) {srv.wPool<- t}(srv, t)
+    case <-srv.ctx.Done():
+        return nil, fmt.Errorf("%s | Error %w", mark, srv.ctx.Err())
+    }
+    orders, err := srv.fetchBatch(query, oids)
+    if err != nil {
+        DBErr := classifyDBError(mark, err)
+        srv.log.Error(fmt.Sprintf("%s | Error... %s", mark, DBErr.Error()))
+        select {
+        case srv.errCh<- DBErr:
+        case <-srv.ctx.Done():
+        }
+        return nil, DBErr
+    }
+    srv.log.Debug(fmt.Sprintf("%s | Found %d of %d orders", mark, len(orders), len(oids)))
+    return orders, nil
 }
 
-func (srv AppStorage) MarkDumped(ch <-chan LogMessage, ca func()) {
+// write dumped cache log into db in one transaction.
+// false - nothing committed, caller puts records back into log.
+func (srv AppStorage) MarkDumped(ch <-chan LogMessage, ca func()) bool {
     // make queries from str array for trans.
     // it will be called from <GatCacheSync>
 
-    query := "UPDATE orders SET evict = $2 WHERE oid = $1"
+    // each instance keeps own state, orders table is shared
+    query := `INSERT INTO order_cache_state (instance_id, oid, evict) VALUES ($1, $2, $3)
+        ON CONFLICT (instance_id, oid) DO UPDATE
+        SET evict = EXCLUDED.evict, updated_at = now()`
 
     var t Token
     mark := "AppStorage.MarkDumpedBG"
     srv.log.Debug(fmt.Sprintf("%s | Started... | Pool %+v, %d", mark, srv.wPool, len(srv.wPool)))
     defer ca()
-    defer func(s AppStorage, t Token) {srv.wPool<- t}(srv, t)
     // writer will close channel
     // or caller close it when ctx will be Done().
     select {
     case <-srv.ctx.Done():
-        return
+        return false
     case t = <-srv.wPool:
+        defer func() {srv.wPool<- t}()
+        start := time.Now()
+        var batch int
         // open transaction
         var Trans psql.Transaction
         var TrError error
@@ -292,28 +591,30 @@ func (srv AppStorage) MarkDumped(ch <-chan LogMessage, ca func()) {
         if TrError != nil {
             select {
             case <-srv.ctx.Done():
-                return
             case srv.errCh<- fmt.Errorf("%s | Error %w", mark, TrError):
-                return
             }
+            return false
         }
         for msg := range ch {
             switch msg.OpCode() {
             case Evicted:
-                Trans.AddQuery(query, string(msg.Payload()), Evicted)
+                Trans.AddQuery(query, srv.instance, string(msg.Payload()), Evicted)
+                batch++
             case Added:
-                Trans.AddQuery(query, string(msg.Payload()), Added)
+                Trans.AddQuery(query, srv.instance, string(msg.Payload()), Added)
+                batch++
             case EmptyLog:
                 Trans.Rollback()
-                return
+                srv.health.markSynced()
+                return true
             default:
                 srv.log.Error(fmt.Sprintf("%s | Unknown op = %d", mark, msg.OpCode()))
                 Trans.Rollback()
                 select {
                 case <-srv.ctx.Done():
                 case srv.errCh<- fmt.Errorf("%s | Unknown opcode %d", mark, msg.OpCode()):
-                    return
                 }
+                return false
             }
         }
         // close transaction
@@ -325,8 +626,56 @@ func (srv AppStorage) MarkDumped(ch <-chan LogMessage, ca func()) {
             case <-srv.ctx.Done():
             case srv.errCh<- fmt.Errorf("%s | Error %w", mark, TrError):
             }
+            return false
         }
-        Trans.Commit()
+        if TrError = Trans.Commit(); TrError != nil {
+            select {
+            case <-srv.ctx.Done():
+            case srv.errCh<- fmt.Errorf("%s | Error %w", mark, TrError):
+            }
+            return false
+        }
+        srv.health.markSynced()
+        metrics.MarkDumpedBatch.Observe(float64(batch))
+        metrics.MarkDumpedDuration.Observe(time.Since(start).Seconds())
     }
-    return
+    return true
+}
+
+// search orders by filter, newest first
+func (srv AppStorage) SearchOrders(f OrderFilter) (OrdersPage, error) {
+    mark := "AppStorage.SearchOrders"
+
+    var t Token
+    var page OrdersPage
+    select {
+    case t = <-srv.wPool:
+        defer func(srv AppStorage, t Token) {srv.wPool<- t}(srv, t)
+    case <-srv.ctx.Done():
+        return page, fmt.Errorf("%s | Error %w", mark, srv.ctx.Err())
+    }
+    query, args := f.build()
+    rows, cancel, err := srv.db.FetchMany(query, args...)
+    if err != nil {
+        return page, classifyDBError(mark, err)
+    }
+    defer cancel()
+    limit := f.limit()
+    for rows.Next() {
+        var ord Order
+        var seq int64
+        if err := rows.Scan(&seq, &ord.Oid, &ord.Payload); err != nil {
+            return OrdersPage{}, classifyDBError(mark, err)
+        }
+        if len(page.Items) == limit {
+            page.HasMore = true
+            break
+        }
+        page.Items = append(page.Items, ord)
+        page.Last = seq
+    }
+    if err := rows.Err(); err != nil {
+        return OrdersPage{}, classifyDBError(mark, err)
+    }
+    return page, nil
 }
@@ -0,0 +1,70 @@
+package services
+
+import (
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestIntakeWait(t *testing.T) {
+    in := &intake{}
+    if !in.add() {
+        t.Fatal("open intake rejected goroutine")
+    }
+    waited := make(chan struct{})
+    go func() {
+        in.wait()
+        close(waited)
+    }()
+    select {
+    case <-waited:
+        t.Fatal("wait returned with goroutine in flight")
+    case <-time.After(50 * time.Millisecond):
+    }
+    // closed while waiting
+    if in.add() {
+        t.Fatal("closed intake accepted goroutine")
+    }
+    in.done()
+    select {
+    case <-waited:
+    case <-time.After(time.Second):
+        t.Fatal("wait is not released")
+    }
+}
+
+// add and wait from different goroutines, run with -race
+func TestIntakeAddDuringWait(t *testing.T) {
+    in := &intake{}
+    var wg sync.WaitGroup
+    for i := 0; i < 8; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for j := 0; j < 100; j++ {
+                if !in.add() {
+                    return
+                }
+                in.done()
+            }
+        }()
+    }
+    in.wait()
+    wg.Wait()
+    if in.add() {
+        t.Fatal("closed intake accepted goroutine")
+    }
+}
+
+func TestSaveOrderAfterWait(t *testing.T) {
+    srv := AppStorage{inflight: &intake{}, log: *discardLog}
+    if !srv.Wait(time.Second) {
+        t.Fatal("empty intake wait timeout")
+    }
+    acked := false
+    // no db: goroutine must not be started at all
+    srv.SaveOrder(&NatsMsg{MsgId: 1, Ack: func() error {acked = true; return nil}})
+    if acked {
+        t.Fatal("order after Wait acked")
+    }
+}
@@ -0,0 +1,290 @@
+package services
+
+import (
+    "fmt"
+    "errors"
+    "context"
+    "log/slog"
+    "sync"
+    "time"
+
+    "nats_app/internal/config"
+)
+
+const (
+    // on_panic modes
+    OnPanicReload string = "reload"
+    OnPanicDie string = "die"
+)
+
+type ErrCategory uint8
+
+const (
+    UnknownErr ErrCategory = iota
+    // db timeout or lost connection
+    TransientDBErr
+    // db answers, but request can`t succeed: schema, auth
+    FatalDBErr
+    // broker connection or subscription lost
+    ConsumerErr
+    // invalid message, already moved to dead letters
+    ValidationErr
+)
+
+func (c ErrCategory) String() string {
+    switch c {
+    case TransientDBErr:
+        return "transient_db"
+    case FatalDBErr:
+        return "fatal_db"
+    case ConsumerErr:
+        return "consumer"
+    case ValidationErr:
+        return "validation"
+    }
+    return "unknown"
+}
+
+type Action uint8
+
+const (
+    // log and continue
+    Ignore Action = iota
+    // run category probe with backoff
+    Retry
+    // recreate subscription with backoff
+    Resubscribe
+    // restart component, no retries before
+    Restart
+    Exit
+)
+
+type Policy struct {
+    Action Action
+    MaxRetries int
+    Backoff time.Duration
+    MaxBackoff time.Duration
+}
+
+// map error into category
+func Classify(err error) ErrCategory {
+    var DBTimeoutErr *DBTimeout
+    var DBLost *DBConnectionLost
+    var DBFatalErr *DBFatal
+    var ConsumerLost *ConsumerDisconnected
+    switch {
+    case errors.As(err, &DBFatalErr):
+        return FatalDBErr
+    case errors.As(err, &DBTimeoutErr) || errors.As(err, &DBLost):
+        return TransientDBErr
+    case errors.As(err, &ConsumerLost):
+        return ConsumerErr
+    case errors.Is(err, InvalidOrder):
+        return ValidationErr
+    }
+    return UnknownErr
+}
+
+// classify errors from main loop and apply restart policies.
+// When recovery fails on_panic decides: "reload" restarts
+// component, "die" stops the app. Recovery runs in background,
+// one per category, main loop only submits errors.
+type Supervisor struct {
+    ctx context.Context
+    cancel func()
+    log *slog.Logger
+    onPanic string
+    policies map[ErrCategory]Policy
+    // backoff for restart hooks
+    restartPolicy Policy
+    // checks that component is alive again
+    probes map[ErrCategory]func() error
+    restarts map[ErrCategory]func() error
+    mu sync.Mutex
+    // categories with recovery in progress
+    recovering map[ErrCategory]bool
+    wg sync.WaitGroup
+    // app must stop, buffered for one
+    fatal chan error
+}
+
+func NewSupervisor(ctx context.Context, onPanic string, conf *config.SupervisorConfig) (*Supervisor, error) {
+    switch onPanic {
+    case OnPanicReload, OnPanicDie:
+    case "":
+        onPanic = OnPanicDie
+    default:
+        return nil, fmt.Errorf("NewSupervisor | Unknown on_panic mode: %s", onPanic)
+    }
+    retry := Policy{
+        MaxRetries: conf.MaxRetries,
+        Backoff: conf.Backoff,
+        MaxBackoff: conf.MaxBackoff,
+    }
+    policies := map[ErrCategory]Policy{
+        UnknownErr: {Action: Ignore},
+        ValidationErr: {Action: Ignore},
+        // schema or constraint failure, reconnect can`t fix it
+        FatalDBErr: {Action: Exit},
+    }
+    retry.Action = Retry
+    policies[TransientDBErr] = retry
+    retry.Action = Resubscribe
+    policies[ConsumerErr] = retry
+    retry.Action = Restart
+    ctx, cancel := context.WithCancel(ctx)
+    return &Supervisor{
+        ctx: ctx,
+        cancel: cancel,
+        onPanic: onPanic,
+        policies: policies,
+        restartPolicy: retry,
+        probes: make(map[ErrCategory]func() error),
+        restarts: make(map[ErrCategory]func() error),
+        recovering: make(map[ErrCategory]bool),
+        fatal: make(chan error, 1),
+        log: slog.Default(),
+    }, nil
+}
+
+func (sv *Supervisor) SetLogger(l *slog.Logger) {
+    (*sv).log = l
+}
+
+func (sv *Supervisor) SetPolicy(cat ErrCategory, p Policy) {
+    (*sv).policies[cat] = p
+}
+
+// probe is used by Retry and Resubscribe actions
+func (sv *Supervisor) SetProbe(cat ErrCategory, probe func() error) {
+    (*sv).probes[cat] = probe
+}
+
+// restart is used by Restart action and "reload" on_panic mode
+func (sv *Supervisor) SetRestart(cat ErrCategory, restart func() error) {
+    (*sv).restarts[cat] = restart
+}
+
+// run fn until success with exponential backoff
+func (sv *Supervisor) withBackoff(p Policy, fn func() error) error {
+    err := fn()
+    delay := p.Backoff
+    for i := 0; err != nil && i < p.MaxRetries; i++ {
+        select {
+        case <-(*sv).ctx.Done():
+            return (*sv).ctx.Err()
+        case <-time.After(delay):
+        }
+        err = fn()
+        delay *= 2
+        if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+            delay = p.MaxBackoff
+        }
+    }
+    return err
+}
+
+// component can`t recover itself, on_panic decides
+func (sv *Supervisor) escalate(cat ErrCategory) bool {
+    mark := "Supervisor.escalate"
+    restart, ok := (*sv).restarts[cat]
+    if (*sv).onPanic == OnPanicDie || !ok {
+        (*sv).log.Error(fmt.Sprintf("%s | %s: can`t recover, exit...", mark, cat))
+        return true
+    }
+    (*sv).log.Warn(fmt.Sprintf("%s | %s: restarting component...", mark, cat))
+    if err := (*sv).withBackoff((*sv).restartPolicy, restart); err != nil {
+        (*sv).log.Error(fmt.Sprintf("%s | %s: restart failed: %s", mark, cat, err.Error()))
+        return true
+    }
+    (*sv).log.Info(fmt.Sprintf("%s | %s: component restarted...", mark, cat))
+    return false
+}
+
+// handle error in background, errors of category
+// with recovery in progress are only logged.
+// App must stop when Fatal() returns error.
+func (sv *Supervisor) Submit(err error) {
+    mark := "Supervisor.Submit"
+    cat := Classify(err)
+    if (*sv).policies[cat].Action == Ignore {
+        (*sv).Handle(err)
+        return
+    }
+    (*sv).mu.Lock()
+    if (*sv).ctx.Err() != nil {
+        // stopped, no new recoveries
+        (*sv).mu.Unlock()
+        (*sv).log.Warn(fmt.Sprintf("%s | %s: supervisor stopped: %s", mark, cat, err.Error()))
+        return
+    }
+    if (*sv).recovering[cat] {
+        (*sv).mu.Unlock()
+        (*sv).log.Warn(fmt.Sprintf("%s | %s: recovery in progress: %s", mark, cat, err.Error()))
+        return
+    }
+    (*sv).recovering[cat] = true
+    (*sv).wg.Add(1)
+    (*sv).mu.Unlock()
+    go func(sv *Supervisor, cat ErrCategory, err error) {
+        defer (*sv).wg.Done()
+        stop := (*sv).Handle(err)
+        (*sv).mu.Lock()
+        delete((*sv).recovering, cat)
+        (*sv).mu.Unlock()
+        if !stop || (*sv).ctx.Err() != nil {
+            return
+        }
+        select {
+        case (*sv).fatal<- fmt.Errorf("%s | %s: %w", mark, cat, err):
+        default:
+            // app is already stopping
+        }
+    }(sv, cat, err)
+}
+
+// error from failed recovery, app must stop
+func (sv *Supervisor) Fatal() <-chan error {
+    return (*sv).fatal
+}
+
+// cancel recovery in progress and wait for it, call on shutdown
+func (sv *Supervisor) Stop() {
+    (*sv).mu.Lock()
+    (*sv).cancel()
+    (*sv).mu.Unlock()
+    (*sv).wg.Wait()
+}
+
+// handle error synchronously, true means app must stop
+func (sv *Supervisor) Handle(err error) bool {
+    mark := "Supervisor.Handle"
+    cat := Classify(err)
+    policy := (*sv).policies[cat]
+    switch policy.Action {
+    case Ignore:
+        if cat == ValidationErr {
+            (*sv).log.Warn(fmt.Sprintf("%s | %s: %s", mark, cat, err.Error()))
+        } else {
+            (*sv).log.Error(fmt.Sprintf("%s | %s: %s", mark, cat, err.Error()))
+        }
+        return false
+    case Retry, Resubscribe:
+        (*sv).log.Error(fmt.Sprintf("%s | %s: %s", mark, cat, err.Error()))
+        probe, ok := (*sv).probes[cat]
+        if !ok {
+            return (*sv).escalate(cat)
+        }
+        if probeErr := (*sv).withBackoff(policy, probe); probeErr != nil {
+            (*sv).log.Error(fmt.Sprintf("%s | %s: retries exhausted: %s", mark, cat, probeErr.Error()))
+            return (*sv).escalate(cat)
+        }
+        (*sv).log.Info(fmt.Sprintf("%s | %s: recovered...", mark, cat))
+        return false
+    case Restart:
+        (*sv).log.Error(fmt.Sprintf("%s | %s: %s", mark, cat, err.Error()))
+        return (*sv).escalate(cat)
+    }
+    (*sv).log.Error(fmt.Sprintf("%s | %s: %s, exit...", mark, cat, err.Error()))
+    return true
+}
@@ -0,0 +1,145 @@
+package services
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "nats_app/internal/config"
+)
+
+func TestClassify(t *testing.T) {
+    cases := []struct {
+        err error
+        want ErrCategory
+    }{
+        {errors.New("boom"), UnknownErr},
+        {&DBTimeout{msg: "timeout"}, TransientDBErr},
+        {fmt.Errorf("wrapped: %w", &DBConnectionLost{msg: "lost"}), TransientDBErr},
+        {&DBFatal{msg: "no table"}, FatalDBErr},
+        {NewConsumerDisconnected("test", errors.New("gone")), ConsumerErr},
+        {fmt.Errorf("%w: bad json", InvalidOrder), ValidationErr},
+    }
+    for _, tc := range cases {
+        if got := Classify(tc.err); got != tc.want {
+            t.Errorf("Classify(%v) = %s, want %s", tc.err, got, tc.want)
+        }
+    }
+}
+
+func testSupervisor(t *testing.T, onPanic string) *Supervisor {
+    t.Helper()
+    sv, err := NewSupervisor(context.Background(), onPanic, &config.SupervisorConfig{
+        MaxRetries: 2,
+        Backoff: time.Millisecond,
+        MaxBackoff: 2 * time.Millisecond,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    sv.SetLogger(discardLog)
+    t.Cleanup(sv.Stop)
+    return sv
+}
+
+func TestNewSupervisorMode(t *testing.T) {
+    if _, err := NewSupervisor(context.Background(), "ignore", &config.SupervisorConfig{}); err == nil {
+        t.Fatal("unknown on_panic accepted")
+    }
+}
+
+func TestSupervisorHandle(t *testing.T) {
+    cases := []struct {
+        name string
+        onPanic string
+        err error
+        // probe fails this many times
+        failures int32
+        restart bool
+        stop bool
+    }{
+        {name: "validation ignored", onPanic: OnPanicDie, err: InvalidOrder},
+        {name: "unknown ignored", onPanic: OnPanicDie, err: errors.New("boom")},
+        {name: "probe recovers", onPanic: OnPanicDie, err: &DBTimeout{}, failures: 2},
+        {name: "retries exhausted, die", onPanic: OnPanicDie, err: &DBTimeout{}, failures: 10, restart: true, stop: true},
+        {name: "retries exhausted, reload", onPanic: OnPanicReload, err: &DBTimeout{}, failures: 10, restart: true},
+        {name: "fatal db stops with reload", onPanic: OnPanicReload, err: &DBFatal{}, restart: true, stop: true},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            sv := testSupervisor(t, tc.onPanic)
+            var probes atomic.Int32
+            sv.SetProbe(TransientDBErr, func() error {
+                if probes.Add(1) <= tc.failures {
+                    return errors.New("still down")
+                }
+                return nil
+            })
+            if tc.restart {
+                sv.SetRestart(TransientDBErr, func() error {return nil})
+                sv.SetRestart(FatalDBErr, func() error {return nil})
+            }
+            if got := sv.Handle(tc.err); got != tc.stop {
+                t.Fatalf("Handle = %v, want %v", got, tc.stop)
+            }
+        })
+    }
+}
+
+func TestSupervisorSubmitAsync(t *testing.T) {
+    sv := testSupervisor(t, OnPanicDie)
+    release := make(chan struct{})
+    var probes atomic.Int32
+    sv.SetProbe(TransientDBErr, func() error {
+        probes.Add(1)
+        <-release
+        return errors.New("still down")
+    })
+    start := time.Now()
+    sv.Submit(&DBTimeout{msg: "first"})
+    // same category while recovering is coalesced
+    sv.Submit(&DBTimeout{msg: "second"})
+    if time.Since(start) > 100 * time.Millisecond {
+        t.Fatal("Submit waits for recovery")
+    }
+    close(release)
+    select {
+    case err := <-sv.Fatal():
+        if Classify(errors.Unwrap(err)) != TransientDBErr {
+            t.Fatalf("unexpected fatal error %v", err)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("failed recovery is not reported")
+    }
+    // one recovery: first try and MaxRetries
+    if n := probes.Load(); n != 3 {
+        t.Fatalf("probes %d, want 3", n)
+    }
+}
+
+func TestSupervisorStop(t *testing.T) {
+    sv := testSupervisor(t, OnPanicDie)
+    sv.SetPolicy(TransientDBErr, Policy{Action: Retry, MaxRetries: 100, Backoff: time.Hour})
+    sv.SetProbe(TransientDBErr, func() error {return errors.New("down")})
+    sv.Submit(&DBTimeout{})
+    done := make(chan struct{})
+    go func() {
+        sv.Stop()
+        close(done)
+    }()
+    select {
+    case <-done:
+    case <-time.After(time.Second):
+        t.Fatal("Stop doesn`t cancel backoff")
+    }
+    select {
+    case err := <-sv.Fatal():
+        t.Fatalf("cancelled recovery reported as fatal: %v", err)
+    default:
+    }
+    // no recoveries after stop
+    sv.Submit(&DBTimeout{})
+}
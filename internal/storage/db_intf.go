@@ -1,6 +1,7 @@
 package storage
 
 import (
+    "context"
     "log/slog"
 
     "github.com/jackc/pgx/v5"
@@ -15,5 +16,9 @@ type DBAdapter interface {
     Save(q string, args ...any) (func(), error)
     FetchOne(q string, args ...any) *psql.SingleOpFuture
     FetchMany(q string, args ...any) (pgx.Rows, func(), error)
+    // stream large results by batches, caller closes cursor
+    FetchCursor(ctx context.Context, batch int, q string, args ...any) (*psql.Cursor, error)
+    // drop all pool connections, new ones are made on demand
+    Reset()
     Disconnect()
 }
@@ -0,0 +1,114 @@
+package psql
+
+import (
+    "context"
+    "fmt"
+    "time"
+
+    "github.com/jackc/pgx/v5"
+)
+
+const (
+    cursorName string = "fetch_cursor"
+    defaultCursorBatch int = 500
+)
+
+// server-side cursor inside read only transaction,
+// rows are fetched by batches, only one batch is in memory
+type Cursor struct {
+    ctx context.Context
+    tx pgx.Tx
+    batch int
+    timeout time.Duration
+    rows pgx.Rows
+    cancel_f func()
+    // rows read from current batch
+    got int
+    done bool
+    err error
+}
+
+// declare cursor for query, ctx limits the whole read,
+// each batch is limited by db timeout
+func (psql PostgreDB) FetchCursor(ctx context.Context, batch int, q string, args ...any) (*Cursor, error) {
+    mark := "PostgreDB.FetchCursor"
+    if batch <= 0 {
+        batch = defaultCursorBatch
+    }
+    tx, err := psql.pool.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+    if err != nil {
+        return nil, fmt.Errorf("%s | Error %w", mark, err)
+    }
+    declare := fmt.Sprintf("DECLARE %s NO SCROLL CURSOR FOR %s", cursorName, q)
+    if _, err = tx.Exec(ctx, declare, args...); err != nil {
+        tx.Rollback(context.Background())
+        return nil, fmt.Errorf("%s | Error %w", mark, err)
+    }
+    return &Cursor{ctx: ctx, tx: tx, batch: batch, timeout: psql.timeout}, nil
+}
+
+func (c *Cursor) closeBatch() {
+    if (*c).rows != nil {
+        (*c).rows.Close()
+        (*c).rows = nil
+    }
+    if (*c).cancel_f != nil {
+        (*c).cancel_f()
+        (*c).cancel_f = nil
+    }
+}
+
+// move to next row, next batch is fetched when current one is read
+func (c *Cursor) Next() bool {
+    mark := "Cursor.Next"
+    for !(*c).done {
+        if (*c).rows != nil {
+            if (*c).rows.Next() {
+                (*c).got++
+                return true
+            }
+            if err := (*c).rows.Err(); err != nil {
+                (*c).err = fmt.Errorf("%s | Error %w", mark, err)
+                (*c).done = true
+                break
+            }
+            // short batch is the last one
+            last := (*c).got < (*c).batch
+            (*c).closeBatch()
+            if last {
+                (*c).done = true
+                break
+            }
+        }
+        tempCtx, cancel := context.WithTimeout((*c).ctx, (*c).timeout)
+        rows, err := (*c).tx.Query(tempCtx, fmt.Sprintf("FETCH %d FROM %s", (*c).batch, cursorName))
+        if err != nil {
+            cancel()
+            (*c).err = fmt.Errorf("%s | Error %w", mark, err)
+            (*c).done = true
+            break
+        }
+        (*c).rows, (*c).cancel_f, (*c).got = rows, cancel, 0
+    }
+    (*c).closeBatch()
+    return false
+}
+
+func (c *Cursor) Scan(dest ...any) error {
+    if (*c).rows == nil {
+        return fmt.Errorf("Cursor.Scan | No current row")
+    }
+    return (*c).rows.Scan(dest...)
+}
+
+func (c *Cursor) Err() error {
+    return (*c).err
+}
+
+// close cursor and finish transaction
+func (c *Cursor) Close() error {
+    (*c).closeBatch()
+    (*c).done = true
+    // read only, nothing to commit
+    return (*c).tx.Rollback(context.Background())
+}
@@ -60,7 +60,9 @@ type Transaction struct {
 
 // method, that check db conn alive
 func (psql PostgreDB) Test() error {
-    if NoPing := (*psql.pool).Ping(psql.Ctx); NoPing != nil {
+    tempCtx, cancel := context.WithTimeout(psql.Ctx, psql.timeout)
+    defer cancel()
+    if NoPing := (*psql.pool).Ping(tempCtx); NoPing != nil {
         return fmt.Errorf("Database is not responding... ERR: %w", NoPing)
     }
     return nil
@@ -95,8 +97,7 @@ func (tr *Transaction) AddQuery(q string, args ...any) error {
     if tr.Batch == nil {
         return errors.New("AQ | No opened transactions...")
     }
-    a := fmt.Sprintf("args => %v, %+v", args, args)
-    tr.log.Info(a)
+    // args hold customer data, they are never logged
     tr.Batch.Queue(q, args...)
     return nil
 }
@@ -109,12 +110,16 @@ func (tr *Transaction) RunTx() error {
         return errors.New("RTX | No opened transactions...")
     }
     br := tr.Tx.SendBatch(tr.Ctx, tr.Batch)
-    if _, Err = br.Exec(); Err != nil {
-        Err = fmt.Errorf("%s | Error on Batch.Exec() %w", mark, Err)
+    // read result of every queued query
+    for i := 0; i < tr.Batch.Len(); i++ {
+        if _, Err = br.Exec(); Err != nil {
+            Err = fmt.Errorf("%s | Error on Batch.Exec() %w", mark, Err)
+            break
+        }
     }
     CloseErr := br.Close()
-    if CloseErr != nil {
-        Err = fmt.Errorf("%s | Error on Batch.Close() %w", mark, Err)
+    if CloseErr != nil && Err == nil {
+        Err = fmt.Errorf("%s | Error on Batch.Close() %w", mark, CloseErr)
     }
     return Err
 }
@@ -187,6 +192,11 @@ func (psql PostgreDB) FetchMany(q string, args ...any) (pgx.Rows, func(), error)
     return rows, shutdown_handler, nil
 }
 
+func (psql PostgreDB) Reset() {
+    psql.pool.Reset()
+    psql.log.Info("DB Pool connections dropped...")
+}
+
 func (psql PostgreDB) Disconnect() {
     //...
     psql.pool.Close()
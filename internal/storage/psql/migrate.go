@@ -0,0 +1,326 @@
+package psql
+
+import (
+    "embed"
+    "errors"
+    "fmt"
+    "io/fs"
+    "path"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    migrationsDir string = "migrations"
+    upSuffix string = ".up.sql"
+    downSuffix string = ".down.sql"
+)
+
+var (
+    SchemaBehind = errors.New("Database schema is behind, run <migrate up>")
+    NoMigrations = errors.New("No applied migrations to revert")
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// one schema version, sql files are named
+// <version>_<name>.up.sql / <version>_<name>.down.sql
+type Migration struct {
+    Version int
+    Name string
+    Up string
+    Down string
+}
+
+type MigrationStatus struct {
+    Migration
+    Applied bool
+    AppliedAt time.Time
+}
+
+type Migrator struct {
+    db *PostgreDB
+    migrations []Migration
+}
+
+// parse <version>_<name> from file name
+func parseMigrationName(file string) (int, string, error) {
+    base := strings.TrimSuffix(strings.TrimSuffix(file, upSuffix), downSuffix)
+    num, name, found := strings.Cut(base, "_")
+    if !found {
+        return 0, "", fmt.Errorf("Invalid migration file name: %s", file)
+    }
+    version, err := strconv.Atoi(num)
+    if err != nil || version <= 0 {
+        return 0, "", fmt.Errorf("Invalid migration version: %s", file)
+    }
+    return version, name, nil
+}
+
+// read embedded migrations ordered by version
+func LoadMigrations() ([]Migration, error) {
+    return loadMigrations(migrationsFS)
+}
+
+func loadMigrations(fsys fs.FS) ([]Migration, error) {
+    mark := "psql.LoadMigrations"
+    entries, err := fs.ReadDir(fsys, migrationsDir)
+    if err != nil {
+        return nil, fmt.Errorf("%s | Error %w", mark, err)
+    }
+    byVersion := make(map[int]*Migration)
+    for _, entry := range entries {
+        file := entry.Name()
+        version, name, err := parseMigrationName(file)
+        if err != nil {
+            return nil, fmt.Errorf("%s | Error %w", mark, err)
+        }
+        body, err := fs.ReadFile(fsys, path.Join(migrationsDir, file))
+        if err != nil {
+            return nil, fmt.Errorf("%s | Error %w", mark, err)
+        }
+        m, ok := byVersion[version]
+        if !ok {
+            m = &Migration{Version: version, Name: name}
+            byVersion[version] = m
+        }
+        switch {
+        case strings.HasSuffix(file, upSuffix):
+            m.Up = string(body)
+        case strings.HasSuffix(file, downSuffix):
+            m.Down = string(body)
+        }
+    }
+    migrations := make([]Migration, 0, len(byVersion))
+    for _, m := range byVersion {
+        if m.Up == "" {
+            return nil, fmt.Errorf("%s | No up migration for version %d", mark, m.Version)
+        }
+        migrations = append(migrations, *m)
+    }
+    sort.Slice(migrations, func(i, j int) bool {
+        return migrations[i].Version < migrations[j].Version
+    })
+    return migrations, nil
+}
+
+func NewMigrator(db *PostgreDB) (*Migrator, error) {
+    migrations, err := LoadMigrations()
+    if err != nil {
+        return nil, err
+    }
+    return &Migrator{db: db, migrations: migrations}, nil
+}
+
+func (m *Migrator) ensureTable() error {
+    mark := "Migrator.ensureTable"
+    _, err := m.db.pool.Exec(
+        m.db.Ctx,
+        `CREATE TABLE IF NOT EXISTS schema_migrations (
+            version     INTEGER PRIMARY KEY,
+            name        TEXT NOT NULL,
+            applied_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+        )`,
+    )
+    if err != nil {
+        return fmt.Errorf("%s | Error %w", mark, err)
+    }
+    return nil
+}
+
+// last known migration version
+func (m *Migrator) Latest() int {
+    if len(m.migrations) == 0 {
+        return 0
+    }
+    return m.migrations[len(m.migrations) - 1].Version
+}
+
+// schema_migrations is created only by migrate up,
+// checks and status don`t change db
+func (m *Migrator) tableExists() (bool, error) {
+    mark := "Migrator.tableExists"
+    var exists bool
+    err := m.db.pool.QueryRow(
+        m.db.Ctx,
+        "SELECT to_regclass('schema_migrations') IS NOT NULL",
+    ).Scan(&exists)
+    if err != nil {
+        return false, fmt.Errorf("%s | Error %w", mark, err)
+    }
+    return exists, nil
+}
+
+// current schema version, 0 if nothing applied
+// or there is no schema_migrations yet
+func (m *Migrator) Current() (int, error) {
+    mark := "Migrator.Current"
+    exists, err := m.tableExists()
+    if err != nil || !exists {
+        return 0, err
+    }
+    var version int
+    err = m.db.pool.QueryRow(
+        m.db.Ctx,
+        "SELECT COALESCE(MAX(version), 0) FROM schema_migrations",
+    ).Scan(&version)
+    if err != nil {
+        return 0, fmt.Errorf("%s | Error %w", mark, err)
+    }
+    return version, nil
+}
+
+// run migration body and update schema_migrations in one transaction
+func (m *Migrator) apply(mg Migration, up bool) error {
+    mark := "Migrator.apply"
+    tx, err := m.db.pool.Begin(m.db.Ctx)
+    if err != nil {
+        return fmt.Errorf("%s | Error %w", mark, err)
+    }
+    defer tx.Rollback(m.db.Ctx)
+    // concurrent migrators wait for each other
+    if _, err = tx.Exec(m.db.Ctx, "LOCK TABLE schema_migrations IN EXCLUSIVE MODE"); err != nil {
+        return fmt.Errorf("%s | Error %w", mark, err)
+    }
+    var applied bool
+    err = tx.QueryRow(
+        m.db.Ctx,
+        "SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)",
+        mg.Version,
+    ).Scan(&applied)
+    if err != nil {
+        return fmt.Errorf("%s | Error %w", mark, err)
+    }
+    if applied == up {
+        // already done by someone else
+        return nil
+    }
+    body := mg.Up
+    record := "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)"
+    args := []any{mg.Version, mg.Name}
+    if !up {
+        body = mg.Down
+        record = "DELETE FROM schema_migrations WHERE version = $1"
+        args = args[:1]
+    }
+    if _, err = tx.Exec(m.db.Ctx, body); err != nil {
+        return fmt.Errorf("%s | Version %d: %w", mark, mg.Version, err)
+    }
+    if _, err = tx.Exec(m.db.Ctx, record, args...); err != nil {
+        return fmt.Errorf("%s | Error %w", mark, err)
+    }
+    if err = tx.Commit(m.db.Ctx); err != nil {
+        return fmt.Errorf("%s | Error %w", mark, err)
+    }
+    return nil
+}
+
+// apply all pending migrations, returns applied ones
+func (m *Migrator) Up() ([]Migration, error) {
+    var done []Migration
+    if err := m.ensureTable(); err != nil {
+        return nil, err
+    }
+    current, err := m.Current()
+    if err != nil {
+        return nil, err
+    }
+    for _, mg := range m.migrations {
+        if mg.Version <= current {
+            continue
+        }
+        if err = m.apply(mg, true); err != nil {
+            return done, err
+        }
+        m.db.log.Info(fmt.Sprintf("Migration %04d_%s applied...", mg.Version, mg.Name))
+        done = append(done, mg)
+    }
+    return done, nil
+}
+
+// revert last applied migration
+func (m *Migrator) Down() (Migration, error) {
+    mark := "Migrator.Down"
+    current, err := m.Current()
+    if err != nil {
+        return Migration{}, err
+    }
+    if current == 0 {
+        return Migration{}, NoMigrations
+    }
+    for _, mg := range m.migrations {
+        if mg.Version != current {
+            continue
+        }
+        if mg.Down == "" {
+            return mg, fmt.Errorf("%s | No down migration for version %d", mark, mg.Version)
+        }
+        if err = m.apply(mg, false); err != nil {
+            return mg, err
+        }
+        m.db.log.Info(fmt.Sprintf("Migration %04d_%s reverted...", mg.Version, mg.Name))
+        return mg, nil
+    }
+    return Migration{}, fmt.Errorf("%s | Unknown applied version %d", mark, current)
+}
+
+// all known migrations with applied state
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+    mark := "Migrator.Status"
+    exists, err := m.tableExists()
+    if err != nil {
+        return nil, err
+    }
+    applied := make(map[int]time.Time)
+    if exists {
+        if applied, err = m.applied(); err != nil {
+            return nil, fmt.Errorf("%s | Error %w", mark, err)
+        }
+    }
+    status := make([]MigrationStatus, 0, len(m.migrations))
+    for _, mg := range m.migrations {
+        at, ok := applied[mg.Version]
+        status = append(status, MigrationStatus{Migration: mg, Applied: ok, AppliedAt: at})
+    }
+    return status, nil
+}
+
+// applied versions with time
+func (m *Migrator) applied() (map[int]time.Time, error) {
+    rows, err := m.db.pool.Query(m.db.Ctx, "SELECT version, applied_at FROM schema_migrations")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    applied := make(map[int]time.Time)
+    for rows.Next() {
+        var version int
+        var at time.Time
+        if err = rows.Scan(&version, &at); err != nil {
+            return nil, err
+        }
+        applied[version] = at
+    }
+    return applied, rows.Err()
+}
+
+// check that db schema is not behind embedded migrations,
+// read only: db without schema_migrations has version 0
+func CheckSchemaVersion(db *PostgreDB) error {
+    mark := "psql.CheckSchemaVersion"
+    m, err := NewMigrator(db)
+    if err != nil {
+        return err
+    }
+    current, err := m.Current()
+    if err != nil {
+        return err
+    }
+    if current < m.Latest() {
+        return fmt.Errorf("%s | Version %d < %d: %w", mark, current, m.Latest(), SchemaBehind)
+    }
+    return nil
+}
@@ -0,0 +1,116 @@
+package psql
+
+import (
+    "testing"
+    "testing/fstest"
+)
+
+func TestParseMigrationName(t *testing.T) {
+    cases := []struct {
+        file string
+        version int
+        name string
+        fail bool
+    }{
+        {file: "0001_init_schema.up.sql", version: 1, name: "init_schema"},
+        {file: "0012_order_versions.down.sql", version: 12, name: "order_versions"},
+        {file: "init.up.sql", fail: true},
+        {file: "x_init.up.sql", fail: true},
+        {file: "0000_zero.up.sql", fail: true},
+        {file: "-1_negative.up.sql", fail: true},
+    }
+    for _, tc := range cases {
+        t.Run(tc.file, func(t *testing.T) {
+            version, name, err := parseMigrationName(tc.file)
+            if tc.fail {
+                if err == nil {
+                    t.Fatalf("accepted: %d %s", version, name)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if version != tc.version || name != tc.name {
+                t.Fatalf("got %d %s, want %d %s", version, name, tc.version, tc.name)
+            }
+        })
+    }
+}
+
+func TestLoadMigrationsFS(t *testing.T) {
+    file := func(body string) *fstest.MapFile {
+        return &fstest.MapFile{Data: []byte(body)}
+    }
+    cases := []struct {
+        name string
+        files fstest.MapFS
+        want []int
+        fail bool
+    }{
+        {
+            name: "ordered by version",
+            files: fstest.MapFS{
+                "migrations/0010_b.up.sql": file("b"),
+                "migrations/0002_a.up.sql": file("a"),
+                "migrations/0002_a.down.sql": file("-a"),
+            },
+            want: []int{2, 10},
+        },
+        {
+            name: "down without up",
+            files: fstest.MapFS{
+                "migrations/0001_a.down.sql": file("-a"),
+            },
+            fail: true,
+        },
+        {
+            name: "bad name",
+            files: fstest.MapFS{
+                "migrations/init.up.sql": file("a"),
+            },
+            fail: true,
+        },
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            got, err := loadMigrations(tc.files)
+            if tc.fail {
+                if err == nil {
+                    t.Fatalf("accepted: %+v", got)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if len(got) != len(tc.want) {
+                t.Fatalf("got %+v, want versions %v", got, tc.want)
+            }
+            for i, mg := range got {
+                if mg.Version != tc.want[i] {
+                    t.Fatalf("got %+v, want versions %v", got, tc.want)
+                }
+            }
+        })
+    }
+}
+
+// embedded migrations: contiguous versions, each one can be reverted
+func TestLoadMigrations(t *testing.T) {
+    migrations, err := LoadMigrations()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(migrations) == 0 {
+        t.Fatal("no embedded migrations")
+    }
+    for i, mg := range migrations {
+        if mg.Version != i + 1 {
+            t.Fatalf("version %d at position %d", mg.Version, i)
+        }
+        if mg.Up == "" || mg.Down == "" {
+            t.Fatalf("version %d: up or down is empty", mg.Version)
+        }
+    }
+}
@@ -0,0 +1,10 @@
+-- baseline: orders table as it was used before migrations,
+-- deployed databases already have it and skip this step.
+-- Decoded order fields are added by 0007_normalized_orders.
+
+CREATE TABLE IF NOT EXISTS orders (
+    seq_idx             BIGSERIAL UNIQUE,
+    oid                 TEXT PRIMARY KEY,
+    raw_ord             JSONB NOT NULL,
+    evict               SMALLINT NOT NULL DEFAULT 0
+);
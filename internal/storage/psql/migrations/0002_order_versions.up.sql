@@ -0,0 +1,9 @@
+-- conflicting payloads for already stored orders (dedup policy "version").
+-- version 1 is the payload in orders.raw_ord
+CREATE TABLE IF NOT EXISTS order_versions (
+    oid                 TEXT NOT NULL REFERENCES orders (oid) ON DELETE CASCADE,
+    version             INTEGER NOT NULL,
+    raw_ord             JSONB NOT NULL,
+    received_at         TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (oid, version)
+);
@@ -0,0 +1,13 @@
+-- messages that can`t be decoded or validated
+CREATE TABLE IF NOT EXISTS dead_letters (
+    id                  BIGSERIAL PRIMARY KEY,
+    subject             TEXT NOT NULL,
+    sequence            BIGINT NOT NULL,
+    msg_timestamp       TIMESTAMPTZ NOT NULL,
+    raw                 BYTEA NOT NULL,
+    error               TEXT NOT NULL,
+    created_at          TIMESTAMPTZ NOT NULL DEFAULT now(),
+    resubmitted_at      TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS dead_letters_subject_sequence_idx ON dead_letters (subject, sequence);
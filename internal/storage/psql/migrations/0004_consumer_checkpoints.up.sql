@@ -0,0 +1,6 @@
+-- last fully persisted message sequence per durable subscription
+CREATE TABLE IF NOT EXISTS consumer_checkpoints (
+    durable_name        TEXT PRIMARY KEY,
+    last_seq            BIGINT NOT NULL,
+    updated_at          TIMESTAMPTZ NOT NULL DEFAULT now()
+);
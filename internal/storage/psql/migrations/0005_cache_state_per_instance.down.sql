@@ -0,0 +1,8 @@
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS evict SMALLINT NOT NULL DEFAULT 0;
+
+-- only state without owner goes back, other instances are lost
+UPDATE orders o SET evict = c.evict
+FROM order_cache_state c
+WHERE c.oid = o.oid AND c.instance_id = '';
+
+DROP TABLE IF EXISTS order_cache_state;
@@ -0,0 +1,18 @@
+-- cache eviction state per service instance,
+-- instances share orders but have own caches
+CREATE TABLE IF NOT EXISTS order_cache_state (
+    instance_id         TEXT NOT NULL,
+    oid                 TEXT NOT NULL REFERENCES orders (oid) ON DELETE CASCADE,
+    evict               SMALLINT NOT NULL DEFAULT 0,
+    updated_at          TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (instance_id, oid)
+);
+
+-- state stored before has no owner: it is kept with empty
+-- instance_id, first started instance claims it
+-- (AppStorage.ClaimCacheState)
+INSERT INTO order_cache_state (instance_id, oid, evict)
+SELECT '', oid, evict FROM orders
+ON CONFLICT (instance_id, oid) DO NOTHING;
+
+ALTER TABLE orders DROP COLUMN IF EXISTS evict;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS dead_letters_subject_sequence_key;
+
+CREATE INDEX IF NOT EXISTS dead_letters_subject_sequence_idx ON dead_letters (subject, sequence);
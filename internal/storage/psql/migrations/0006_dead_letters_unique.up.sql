@@ -0,0 +1,9 @@
+-- redelivered invalid message is stored once,
+-- keep the first copy of existing duplicates
+DELETE FROM dead_letters d
+    USING dead_letters o
+    WHERE d.subject = o.subject AND d.sequence = o.sequence AND d.id > o.id;
+
+DROP INDEX IF EXISTS dead_letters_subject_sequence_idx;
+
+CREATE UNIQUE INDEX IF NOT EXISTS dead_letters_subject_sequence_key ON dead_letters (subject, sequence);
@@ -0,0 +1,15 @@
+DROP TABLE IF EXISTS order_items;
+DROP TABLE IF EXISTS payments;
+DROP TABLE IF EXISTS deliveries;
+
+ALTER TABLE orders
+    DROP COLUMN IF EXISTS track_number,
+    DROP COLUMN IF EXISTS entry,
+    DROP COLUMN IF EXISTS locale,
+    DROP COLUMN IF EXISTS internal_signature,
+    DROP COLUMN IF EXISTS customer_id,
+    DROP COLUMN IF EXISTS delivery_service,
+    DROP COLUMN IF EXISTS shardkey,
+    DROP COLUMN IF EXISTS sm_id,
+    DROP COLUMN IF EXISTS date_created,
+    DROP COLUMN IF EXISTS oof_shard;
@@ -0,0 +1,143 @@
+-- decoded order fields and normalized delivery, payment, items.
+-- Orders stored before are filled from raw_ord.
+
+ALTER TABLE orders
+    ADD COLUMN IF NOT EXISTS track_number        TEXT,
+    ADD COLUMN IF NOT EXISTS entry               TEXT,
+    ADD COLUMN IF NOT EXISTS locale              TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS internal_signature  TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS customer_id         TEXT,
+    ADD COLUMN IF NOT EXISTS delivery_service    TEXT,
+    ADD COLUMN IF NOT EXISTS shardkey            TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS sm_id               INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS date_created        TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS oof_shard           TEXT NOT NULL DEFAULT '';
+
+UPDATE orders SET
+    track_number = COALESCE(raw_ord->>'track_number', ''),
+    entry = COALESCE(raw_ord->>'entry', ''),
+    locale = COALESCE(raw_ord->>'locale', ''),
+    internal_signature = COALESCE(raw_ord->>'internal_sinature', ''),
+    customer_id = COALESCE(raw_ord->>'customer_id', ''),
+    delivery_service = COALESCE(raw_ord->>'delivery_service', ''),
+    shardkey = COALESCE(raw_ord->>'shardkey', ''),
+    sm_id = COALESCE((raw_ord->>'sm_id')::INTEGER, 0),
+    -- unknown creation time is the epoch
+    date_created = COALESCE((raw_ord->>'date_created')::TIMESTAMPTZ, 'epoch'),
+    oof_shard = COALESCE(raw_ord->>'oof_shard', '')
+WHERE track_number IS NULL;
+
+ALTER TABLE orders
+    ALTER COLUMN track_number SET NOT NULL,
+    ALTER COLUMN entry SET NOT NULL,
+    ALTER COLUMN customer_id SET NOT NULL,
+    ALTER COLUMN delivery_service SET NOT NULL,
+    ALTER COLUMN date_created SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS orders_customer_id_idx ON orders (customer_id);
+CREATE INDEX IF NOT EXISTS orders_track_number_idx ON orders (track_number);
+CREATE INDEX IF NOT EXISTS orders_date_created_idx ON orders (date_created);
+
+CREATE TABLE IF NOT EXISTS deliveries (
+    oid                 TEXT PRIMARY KEY REFERENCES orders (oid) ON DELETE CASCADE,
+    name                TEXT NOT NULL DEFAULT '',
+    phone               TEXT NOT NULL DEFAULT '',
+    zip                 TEXT NOT NULL,
+    city                TEXT NOT NULL,
+    address             TEXT NOT NULL,
+    region              TEXT NOT NULL DEFAULT '',
+    email               TEXT NOT NULL
+);
+
+INSERT INTO deliveries (oid, name, phone, zip, city, address, region, email)
+SELECT
+    oid,
+    COALESCE(raw_ord->'delivery'->>'name', ''),
+    COALESCE(raw_ord->'delivery'->>'phone', ''),
+    COALESCE(raw_ord->'delivery'->>'zip', ''),
+    COALESCE(raw_ord->'delivery'->>'city', ''),
+    COALESCE(raw_ord->'delivery'->>'address', ''),
+    COALESCE(raw_ord->'delivery'->>'region', ''),
+    COALESCE(raw_ord->'delivery'->>'email', '')
+FROM orders
+WHERE jsonb_typeof(raw_ord->'delivery') = 'object'
+ON CONFLICT (oid) DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS payments (
+    oid                 TEXT PRIMARY KEY REFERENCES orders (oid) ON DELETE CASCADE,
+    transaction         TEXT NOT NULL,
+    request_id          TEXT NOT NULL DEFAULT '',
+    currency            TEXT NOT NULL DEFAULT '',
+    provider            TEXT NOT NULL DEFAULT '',
+    amount              INTEGER NOT NULL DEFAULT 0,
+    -- unix time
+    payment_dt          BIGINT NOT NULL,
+    bank                TEXT NOT NULL,
+    delivery_cost       INTEGER NOT NULL DEFAULT 0,
+    goods_total         INTEGER NOT NULL DEFAULT 0,
+    custom_fee          INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS payments_transaction_idx ON payments (transaction);
+
+INSERT INTO payments (
+    oid, transaction, request_id, currency, provider, amount, payment_dt,
+    bank, delivery_cost, goods_total, custom_fee
+)
+SELECT
+    oid,
+    COALESCE(raw_ord->'payment'->>'transaction', ''),
+    COALESCE(raw_ord->'payment'->>'request_id', ''),
+    COALESCE(raw_ord->'payment'->>'currency', ''),
+    COALESCE(raw_ord->'payment'->>'provider', ''),
+    COALESCE((raw_ord->'payment'->>'amount')::INTEGER, 0),
+    COALESCE((raw_ord->'payment'->>'payment_dt')::BIGINT, 0),
+    COALESCE(raw_ord->'payment'->>'bank', ''),
+    COALESCE((raw_ord->'payment'->>'delivery_cost')::INTEGER, 0),
+    COALESCE((raw_ord->'payment'->>'goods_total')::INTEGER, 0),
+    COALESCE((raw_ord->'payment'->>'customs_fee')::INTEGER, 0)
+FROM orders
+WHERE jsonb_typeof(raw_ord->'payment') = 'object'
+ON CONFLICT (oid) DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS order_items (
+    id                  BIGSERIAL PRIMARY KEY,
+    oid                 TEXT NOT NULL REFERENCES orders (oid) ON DELETE CASCADE,
+    chrt_id             BIGINT NOT NULL,
+    track_number        TEXT NOT NULL,
+    price               INTEGER NOT NULL DEFAULT 0,
+    rid                 TEXT NOT NULL DEFAULT '',
+    name                TEXT NOT NULL DEFAULT '',
+    sale                INTEGER NOT NULL DEFAULT 0,
+    size                TEXT NOT NULL DEFAULT '',
+    total_price         INTEGER NOT NULL DEFAULT 0,
+    nm_id               BIGINT NOT NULL DEFAULT 0,
+    brand               TEXT NOT NULL DEFAULT '',
+    status              INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS order_items_oid_idx ON order_items (oid);
+
+-- orders with items already stored are skipped
+INSERT INTO order_items (
+    oid, chrt_id, track_number, price, rid, name, sale, size,
+    total_price, nm_id, brand, status
+)
+SELECT
+    o.oid,
+    COALESCE((it->>'chrt_id')::BIGINT, 0),
+    COALESCE(it->>'track_number', ''),
+    COALESCE((it->>'price')::INTEGER, 0),
+    COALESCE(it->>'rid', ''),
+    COALESCE(it->>'name', ''),
+    COALESCE((it->>'sale')::INTEGER, 0),
+    COALESCE(it->>'size', ''),
+    COALESCE((it->>'total_price')::INTEGER, 0),
+    COALESCE((it->>'nm_id')::BIGINT, 0),
+    COALESCE(it->>'brand', ''),
+    COALESCE((it->>'status')::INTEGER, 0)
+FROM orders o
+CROSS JOIN LATERAL jsonb_array_elements(
+    CASE WHEN jsonb_typeof(o.raw_ord->'items') = 'array' THEN o.raw_ord->'items' ELSE '[]' END
+) it
+WHERE NOT EXISTS (SELECT 1 FROM order_items x WHERE x.oid = o.oid);
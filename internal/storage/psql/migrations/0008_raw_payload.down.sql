@@ -0,0 +1,2 @@
+ALTER TABLE order_versions DROP COLUMN IF EXISTS raw_payload;
+ALTER TABLE orders DROP COLUMN IF EXISTS raw_payload;
@@ -0,0 +1,12 @@
+-- exact payload bytes as received. raw_ord is jsonb copy
+-- for queries: postgres reorders keys, drops whitespace
+-- and duplicate keys there. Orders stored before keep
+-- normalized text, exact bytes were never saved for them.
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS raw_payload BYTEA;
+UPDATE orders SET raw_payload = convert_to(raw_ord::text, 'UTF8') WHERE raw_payload IS NULL;
+ALTER TABLE orders ALTER COLUMN raw_payload SET NOT NULL;
+
+ALTER TABLE order_versions ADD COLUMN IF NOT EXISTS raw_payload BYTEA;
+UPDATE order_versions SET raw_payload = convert_to(raw_ord::text, 'UTF8') WHERE raw_payload IS NULL;
+ALTER TABLE order_versions ALTER COLUMN raw_payload SET NOT NULL;
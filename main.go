@@ -2,9 +2,13 @@ package main
 
 import (
     "fmt"
+    "errors"
     "context"
     "log/slog"
     "time"
+    "os"
+    "os/signal"
+    "syscall"
     "net/http"
 
     "github.com/go-chi/chi/v5"
@@ -16,6 +20,8 @@ import (
     "nats_app/internal/storage/psql"
     "nats_app/internal/nats_client"
     "nats_app/internal/services"
+    "nats_app/internal/metrics"
+    http_server "nats_app/internal/http-server"
     api "nats_app/internal/http-server/handlers/api"
 )
 
@@ -31,14 +37,21 @@ var (
     dbAdapter *psql.PostgreDB
     Conf *config.AppConfig
     Cache services.AppCache
+    L2Cache *services.RedisL2
     Storage services.AppStorage
-    Consumer nats_client.AppConsumer
-    LogStateSync func()
+    Consumer nats_client.Subscriber
+    Supervisor *services.Supervisor
+    LogStateSync func() <-chan struct{}
+    Server *http.Server
+    Health *services.Health
+    Feed *services.OrderFeed
+    // cache state keys taken over from previous version
+    Claimed int64
     logger slog.Logger
 )
 
 // bootstrap
-func init() {
+func bootstrap() {
     ErrCh := make(chan error)
     GetErrChan = func() <-chan error {return ErrCh}
     // we will use logger.Fatal
@@ -55,16 +68,42 @@ func init() {
     psql.Ping(dbAdapter)
 
     logger.Debug("DB answered...")
+    if err := psql.CheckSchemaVersion(dbAdapter); err != nil {
+        logger.Error(fmt.Sprintf("Refuse to start: %s", err.Error()))
+        os.Exit(1)
+    }
+
     PoolSize := Conf.StoragePoolSize
     Storage = services.NewStorage(Ctx, *dbAdapter, PoolSize, ErrCh)
+    Storage.SetCheckpointName(nats_client.CheckpointName(Conf))
+    Feed = services.NewOrderFeed(Conf.HTTPConf.FeedBuffer, Conf.HTTPConf.FeedMaxClients)
+    Storage.SetFeed(Feed)
+    Storage.SetExportLimit(Conf.HTTPConf.MaxExports)
+    Storage.SetInstanceId(Conf.InstanceId)
+    var ClaimErr error
+    Claimed, ClaimErr = Storage.ClaimCacheState()
+    if ClaimErr != nil {
+        logger.Error(fmt.Sprintf("Error on cache state claim: %s", ClaimErr.Error()))
+        os.Exit(1)
+    }
+    if Claimed > 0 {
+        logger.Info(fmt.Sprintf("Cache state of %d keys taken over from previous version...", Claimed))
+    }
+    if err := Storage.SetDedupPolicy(Conf.DedupPolicy); err != nil {
+        logger.Error(err.Error())
+        os.Exit(1)
+    }
     Storage.SetLogger(logger)
 
-    Consumer = nats_client.NewStanConsumer(Ctx, ErrCh, &Conf.StanConf)
-    Consumer.SetStorageOnCallback(&Storage)
-    Consumer.SetLogger(&logger)
+    var SubErr error
+    Consumer, SubErr = newConsumer(ErrCh)
+    if SubErr != nil {
+        logger.Error(SubErr.Error())
+        os.Exit(1)
+    }
 
     // setup Cache
-    LRUCache := services.NewLRUCache(&Conf.CacheConf).
+    MemCache, CacheErr := services.NewMemCache(&Conf.CacheConf).
         OnEvict(
             func(key string, val *[]byte) {
                 Cache.MarkEvicted(key)
@@ -76,23 +115,108 @@ func init() {
                 Cache.MarkAdded(key)
             },
         ).
-        OnLoad(func(key string) services.Order {
+        OnLoad(func(key string) (services.Order, error) {
             return Storage.FetchOrder(key)
         }).
         Build()
-    Cache = services.NewCacheService(&Ctx, ErrCh, LRUCache)
+    if CacheErr != nil {
+        logger.Error(CacheErr.Error())
+        os.Exit(1)
+    }
+    Cache = services.NewCacheService(&Ctx, ErrCh, MemCache)
+    Cache.SetMissPolicy(&Conf.CacheConf)
+    if err := Cache.SetLogPolicy(&Conf.CacheConf); err != nil {
+        logger.Error(err.Error())
+        os.Exit(1)
+    }
+    if Conf.L2Conf.Addr != "" {
+        L2Cache = services.NewRedisL2(&Conf.L2Conf)
+        Cache.SetL2(L2Cache)
+    }
     Cache.SetLogger(&logger)
 
     // we will call this func from main 
     // to sync cache with db
     LogStateSync = Cache.GetCacheSync(
         Conf.TSUpdateInterval,
-        func(c <-chan services.LogMessage, ca func()) {
-            Storage.MarkDumped(c, ca)
-            return
+        func(c <-chan services.LogMessage, ca func()) bool {
+            return Storage.MarkDumped(c, ca)
         },
     )
 
+    Supervisor = setupSupervisor(ErrCh)
+
+    Health = services.NewHealth()
+    Health.Register("db", Storage.DBStatus)
+    Health.Register("broker", func() services.ComponentStatus {
+        state := currentConsumer().State()
+        status := services.ComponentStatus{
+            Ok: state.Connected && state.Subscribed,
+            Details: map[string]any{
+                "broker": state.Broker,
+                "connected": state.Connected,
+                "subscribed": state.Subscribed,
+                "reconnecting": state.Reconnecting,
+                "reconnects": state.Reconnects,
+            },
+        }
+        if state.LastError != "" {
+            status.Details["last_error"] = state.LastError
+        }
+        if !status.Ok {
+            status.Error = "consumer is not connected or subscribed"
+        }
+        return status
+    })
+    Health.Register("cache", Storage.CacheStatus)
+    Health.Register("cache_l2", Cache.L2Status)
+    Health.Register("cache_sync", func() services.ComponentStatus {
+        // few missed ticks are allowed
+        return Storage.SyncStatus(3 * Conf.TSUpdateInterval)
+    })
+
+    metrics.RegisterGauge(
+        "storage_pool_in_use",
+        "Storage pool tokens taken by db operations.",
+        func() float64 {return float64(Storage.PoolInUse())},
+    )
+    metrics.RegisterGauge(
+        "cache_log_pending",
+        "Cache log records waiting for sync with db.",
+        func() float64 {return float64(Cache.PendingLog())},
+    )
+    metrics.RegisterGauge(
+        "cache_bytes",
+        "Payload bytes stored in cache.",
+        func() float64 {
+            bytes, _ := Cache.Usage()
+            return float64(bytes)
+        },
+    )
+    metrics.RegisterGauge(
+        "cache_entries",
+        "Items stored in cache.",
+        func() float64 {
+            _, entries := Cache.Usage()
+            return float64(entries)
+        },
+    )
+    metrics.RegisterGauge(
+        "feed_subscribers",
+        "Clients connected to live order feed.",
+        func() float64 {return float64(Feed.Subscribers())},
+    )
+    metrics.RegisterCounter(
+        "orders_duplicates_total",
+        "Redelivered orders with same payload.",
+        func() float64 {return float64(Storage.DedupStats().Duplicates)},
+    )
+    metrics.RegisterCounter(
+        "orders_conflicts_total",
+        "Redelivered orders with different payload.",
+        func() float64 {return float64(Storage.DedupStats().Conflicts)},
+    )
+
     logger.Debug("Setup for start...")
     data_chan := Storage.GetChannel()
     Cache.Listen(data_chan)
@@ -100,24 +224,90 @@ func init() {
     return
 }
 
-// on shutdown
+// on shutdown: ordered draining
 func on_shutdown(cancel func()) {
     //...
     logger.Info("Stopping services...")
     defer cancel()
+    timeout := Conf.HTTPConf.ShutdownTimeout
+
+    // main loop is stopped, but goroutines still can report errors
+    drainDone := make(chan struct{})
+    defer close(drainDone)
+    go func(Errors <-chan error) {
+        for {
+            select {
+            case err := <-Errors:
+                logger.Error(fmt.Sprintf("on_shutdown | Error: %s", err.Error()))
+            case <-drainDone:
+                return
+            }
+        }
+    }(GetErrChan())
+
+    if Supervisor != nil {
+        logger.Info("Stopping supervisor...")
+        // no component restarts while draining
+        Supervisor.Stop()
+    }
+
+    if Server != nil {
+        logger.Info("Stopping HTTP server...")
+        // feed streams never finish by themselves
+        Feed.Close()
+        httpCtx, httpCancel := context.WithTimeout(context.Background(), timeout)
+        if err := Server.Shutdown(httpCtx); err != nil {
+            logger.Error(fmt.Sprintf("Error on HTTP shutdown: %s", err.Error()))
+        }
+        httpCancel()
+    }
+
+    logger.Info("Stopping consumer...")
+    currentConsumer().Stop()
+
+    logger.Info("Waiting for in-flight orders...")
+    if !Storage.Wait(timeout) {
+        logger.Warn("Some orders are not saved, they will be redelivered...")
+    }
+
+    logger.Info("Final cache log sync...")
+    select {
+    case <-LogStateSync():
+    case <-time.After(timeout):
+        logger.Warn("Cache log sync timeout...")
+    }
+
+    if path := Conf.CacheConf.SnapshotPath; path != "" {
+        if saved, err := Cache.SaveSnapshot(path); err != nil {
+            logger.Error(fmt.Sprintf("Error on cache snapshot: %s", err.Error()))
+        } else {
+            logger.Info(fmt.Sprintf("Cache snapshot saved: %d items...", saved))
+        }
+    }
 
     logger.Info("Disconnection...")
-    err := Consumer.Disconnect()
+    err := currentConsumer().Disconnect()
     if err != nil {
         logger.Error(fmt.Sprintf("Error on disconnect: %s", err.Error()))
     }
     Storage.Disconnect()
+    if L2Cache != nil {
+        L2Cache.Close()
+    }
     logger.Info("Done...")
     return
 }
 
 func main () {
 
+    if len(os.Args) > 1 && os.Args[1] == MigrateCmd {
+        os.Exit(runMigrate(os.Args[2:]))
+    }
+    if len(os.Args) > 1 && os.Args[1] == CacheBenchCmd {
+        os.Exit(runCacheBench(os.Args[2:]))
+    }
+    bootstrap()
+
     var intError error
     Errors := GetErrChan()
     defer on_shutdown(Cancel)
@@ -125,33 +315,49 @@ func main () {
     logger.Debug("Run services...")
     Cache.Run()
 
+    // keys from snapshot are not restored from db
+    var Restored []string
+    if path := Conf.CacheConf.SnapshotPath; path != "" {
+        loaded, err := Cache.LoadSnapshot(path, Conf.CacheConf.SnapshotMaxAge)
+        Restored = loaded
+        switch {
+        case errors.Is(err, os.ErrNotExist):
+            logger.Info("No cache snapshot found...")
+        case err != nil:
+            logger.Warn(fmt.Sprintf("Cache snapshot skipped: %s", err.Error()))
+        default:
+            logger.Info(fmt.Sprintf("Cache snapshot loaded: %d items...", len(loaded)))
+        }
+        Cache.RunSnapshots(path, Conf.CacheConf.SnapshotInterval)
+    }
+
     logger.Debug("Checking start mode...")
-    if Crashed := services.CheckCrashed(); Crashed {
-        logger.Debug("Start in rebuild mode...")
+    LastSeq, Crashed, CheckpointErr := Storage.LastCheckpoint()
+    if CheckpointErr != nil {
+        logger.Error(fmt.Sprintf("Error on checkpoint read: %s", CheckpointErr.Error()))
+        return
+    }
+    if Crashed {
+        logger.Debug(fmt.Sprintf("Start in rebuild mode from seq %d...", LastSeq + 1))
         // now we send errors to errChannel
-        Storage.RestoreCache(Conf.RestoreRecordsLimit, Conf.TSUpdateInterval)
-        LastTimestamp, TSErr:= services.GetPreviousTS(&logger)
-        if TSErr != nil {
-            logger.Error(fmt.Sprintf("Error %s", TSErr.Error()))
-            return
-        }
-        err := Consumer.RunFromTimestamp(LastTimestamp)
+        Storage.RestoreCache(Conf.RestoreRecordsLimit, Conf.TSUpdateInterval, Restored)
+        err := Consumer.RunFromSequence(LastSeq + 1)
         if err != nil {
             logger.Error(fmt.Sprintf("Error on consumer start: %s", err.Error()))
             return
         }
     } else {
         logger.Debug("Start in normal mode...")
-        FileCreationErr := services.MakeNewTSFile(&logger)
-        if FileCreationErr != nil {
-            logger.Error(fmt.Sprintf("Error: %+v", FileCreationErr))
+        if nats_client.CheckpointName(Conf) == "" || Claimed > 0 {
+            // queue group member, broker keeps position
+            // and cache state of instance is restored anyway;
+            // first start after upgrade has no checkpoint yet
+            Storage.RestoreCache(Conf.RestoreRecordsLimit, Conf.TSUpdateInterval, Restored)
+        }
+        err := Consumer.Run()
+        if err != nil {
+            logger.Error(fmt.Sprintf("Error on consumer start: %s", err.Error()))
             return
-        } else {
-            err := Consumer.Run()
-            if err != nil {
-                logger.Error(fmt.Sprintf("Error on consumer start: %s", err.Error()))
-                return
-            }
         }
     }
 
@@ -167,34 +373,64 @@ func main () {
     router.Use(cors.Handler)
     router.Use(middleware.RequestID)
     router.Use(middleware.Recoverer)
-    router.Post("/orders", api.GetOrder(RequestValidator, &Cache, Storage))
-    go http.ListenAndServe(":8000", router)
+    router.Use(metrics.HTTPMiddleware)
+    router.Handle("/metrics", metrics.Handler())
+    // long streaming response, no handler timeout
+    router.With(middleware.Compress(5, "application/x-ndjson", "text/csv")).
+        Get("/api/v1/orders/export", api.ExportOrders(Storage))
+    router.Get("/api/v1/orders/feed", api.OrderFeed(Feed, Conf.HTTPConf.FeedHeartbeat))
+    router.Group(func(r chi.Router) {
+        // handler timeout, streaming routes are set outside
+        r.Use(middleware.Timeout(Conf.HTTPConf.ResponseTimeout))
+        r.Get("/healthz", api.Healthz(Health))
+        r.Get("/readyz", api.Readyz(Health))
+        r.Post("/orders", api.GetOrder(RequestValidator, &Cache, Storage))
+        r.Route("/api/v1", func(r chi.Router) {
+            r.Get("/orders", api.ListOrders(Storage))
+            r.Get("/orders/{order_uid}", api.GetOrderByUid(&Cache))
+            r.Post("/orders:batchGet", api.BatchGetOrders(&Cache, Storage, Conf.HTTPConf.BatchGetLimit))
+            r.Get("/cache/stats", api.GetCacheStats(&Cache))
+            r.Get("/dead-letters", api.ListDeadLetters(Storage))
+            r.Get("/dead-letters/{id}", api.GetDeadLetter(Storage))
+            r.Post("/dead-letters/{id}/resubmit", api.ResubmitDeadLetter(Storage))
+        })
+    })
+    Server = http_server.New(&Conf.HTTPConf, router)
+    ServeErr := make(chan error, 1)
+    go func() {
+        logger.Info(fmt.Sprintf("HTTP server listen on %s...", Server.Addr))
+        if err := Server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+            ServeErr<- err
+        }
+    }()
+
+    Signals, StopSignals := signal.NotifyContext(Ctx, syscall.SIGINT, syscall.SIGTERM)
+    defer StopSignals()
 
     // main loop
     ticker := time.NewTicker(Conf.TSUpdateInterval)
-    var tstamp time.Time
+    defer ticker.Stop()
     for {
         logger.Info("Running...")
         select {
+        case <-Signals.Done():
+            logger.Info("Shutdown signal received...")
+            return
+        case err := <-ServeErr:
+            logger.Error(fmt.Sprintf("HTTP server failed: %s", err.Error()))
+            return
         case intError = <-Errors:
-            logger.Error(fmt.Sprintf("main | Error: %s", intError.Error()))
-            var DBCritical *services.DBConnectionLost
-            switch intError {
-                case DBCritical: 
-                    if _, err := Storage.TestConnection(); err != nil {
-                        logger.Error("DB connection lost...")
-                        return
-                    }
-                    logger.Info("DB connection found...")
-                default:
-                    logger.Error(fmt.Sprintf("[MAIN] Trapped: %v | %+v", intError, intError))
-                    break
-            }
-        case tstamp = <-ticker.C:
+            // recovery runs in background
+            Supervisor.Submit(intError)
+        case err := <-Supervisor.Fatal():
+            logger.Error(fmt.Sprintf("Can`t recover: %s", err.Error()))
+            return
+        case <-ticker.C:
             // sync cache with db
-            // write new ts into .created file
             LogStateSync()
-            services.UpdateTimestamp(tstamp, &logger)
+        case <-Cache.FlushRequests():
+            // cache log is full
+            LogStateSync()
         }
     }
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "errors"
+
+    "nats_app/internal/config"
+    "nats_app/internal/storage/psql"
+)
+
+const (
+    MigrateCmd string = "migrate"
+    migrateUsage string = "Usage: nats_app migrate up|down|status"
+)
+
+// nats_app migrate up|down|status
+// returns process exit code
+func runMigrate(args []string) int {
+    if len(args) != 1 {
+        fmt.Fprintln(os.Stderr, migrateUsage)
+        return 2
+    }
+    conf := config.MustBuildConfig(AppConfPathKey)
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    db := psql.NewDB(ctx, &conf.DBConf)
+    defer db.Disconnect()
+    psql.Ping(db)
+
+    migrator, err := psql.NewMigrator(db)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+        return 1
+    }
+    switch args[0] {
+    case "up":
+        applied, err := migrator.Up()
+        for _, m := range applied {
+            fmt.Printf("applied  %04d_%s\n", m.Version, m.Name)
+        }
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+            return 1
+        }
+        if len(applied) == 0 {
+            fmt.Println("schema is up to date")
+        }
+    case "down":
+        m, err := migrator.Down()
+        if errors.Is(err, psql.NoMigrations) {
+            fmt.Println("nothing to revert")
+            return 0
+        }
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+            return 1
+        }
+        fmt.Printf("reverted %04d_%s\n", m.Version, m.Name)
+    case "status":
+        status, err := migrator.Status()
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+            return 1
+        }
+        for _, s := range status {
+            state := "pending"
+            if s.Applied {
+                state = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+            }
+            fmt.Printf("%04d_%-32s %s\n", s.Version, s.Name, state)
+        }
+    default:
+        fmt.Fprintln(os.Stderr, migrateUsage)
+        return 2
+    }
+    return 0
+}
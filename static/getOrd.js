@@ -67,4 +67,43 @@ async function displayData(data) {
     }
 }
 
+// live feed over Server-Sent Events
+function orderFeed() {
+    const toggle = document.getElementById('feed_toggle');
+    const list = document.getElementById('feed_list');
+    var source = null;
+
+    function stop() {
+        source.close();
+        source = null;
+        toggle.value = "Подписаться";
+    }
+
+    function start() {
+        const service = document.getElementById('feed_filter').value;
+        var reqURL = `http://localhost:8000/api/v1/orders/feed`;
+        if (service) {
+            reqURL += `?delivery_service=${encodeURIComponent(service)}`;
+        }
+        source = new EventSource(reqURL);
+        source.addEventListener('order', (event) => {
+            const order = JSON.parse(event.data);
+            const item = document.createElement('li');
+            item.innerHTML = `<code>${order.order_uid}</code>`;
+            // show full order on click
+            item.addEventListener('click', () => loadDataFromServer(order.order_uid));
+            list.prepend(item);
+        });
+        // server dropped us, don`t reconnect
+        source.addEventListener('close', (event) => {
+            console.log(`Feed closed: ${event.data}`);
+            stop();
+        });
+        toggle.value = "Отписаться";
+    }
+
+    toggle.addEventListener('click', () => source ? stop() : start());
+}
+
 getOrder();
+orderFeed();
@@ -0,0 +1,99 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "sync"
+
+    "nats_app/internal/nats_client"
+    "nats_app/internal/services"
+)
+
+// Consumer is replaced by supervisor restart
+var consumerMu sync.RWMutex
+
+func currentConsumer() nats_client.Subscriber {
+    consumerMu.RLock()
+    defer consumerMu.RUnlock()
+    return Consumer
+}
+
+// build subscriber for configured broker, bound to storage
+func newConsumer(errCh chan<- error) (nats_client.Subscriber, error) {
+    consumer, err := nats_client.NewSubscriber(Ctx, errCh, Conf)
+    if err != nil {
+        return nil, err
+    }
+    consumer.SetStorageOnCallback(&Storage)
+    consumer.SetLogger(&logger)
+    return consumer, nil
+}
+
+// sequence to resume consumer from, 0 if nothing stored yet
+func resumeSeq() (uint64, error) {
+    LastSeq, found, err := Storage.LastCheckpoint()
+    if err != nil || !found {
+        return 0, err
+    }
+    return LastSeq + 1, nil
+}
+
+// set probes and restart hooks for supervised components
+func setupSupervisor(errCh chan<- error) *services.Supervisor {
+    sv, err := services.NewSupervisor(Ctx, Conf.OnPanic, &Conf.SupervisorConf)
+    if err != nil {
+        logger.Error(err.Error())
+        os.Exit(1)
+    }
+    sv.SetLogger(&logger)
+
+    probeDB := func() error {
+        _, err := Storage.TestConnection()
+        return err
+    }
+    sv.SetProbe(services.TransientDBErr, probeDB)
+    sv.SetRestart(services.TransientDBErr, Storage.Reconnect)
+    // FatalDBErr has no restart: schema or constraint
+    // failure is not fixed by reconnect, app stops
+
+    sv.SetProbe(services.ConsumerErr, func() error {
+        seq, err := resumeSeq()
+        if err != nil {
+            return err
+        }
+        if seq == 0 {
+            return currentConsumer().Resubscribe(1)
+        }
+        return currentConsumer().Resubscribe(seq)
+    })
+    // new connection and subscription from checkpoint.
+    // Old connection goes first: broker rejects same client_id
+    // while it is registered. Disconnect is safe to repeat on retries.
+    sv.SetRestart(services.ConsumerErr, func() error {
+        seq, err := resumeSeq()
+        if err != nil {
+            return err
+        }
+        if DisconnErr := currentConsumer().Disconnect(); DisconnErr != nil {
+            logger.Warn(fmt.Sprintf("Old consumer disconnect: %s", DisconnErr.Error()))
+        }
+        next, err := newConsumer(errCh)
+        if err != nil {
+            return err
+        }
+        if seq == 0 {
+            err = next.Run()
+        } else {
+            err = next.RunFromSequence(seq)
+        }
+        if err != nil {
+            next.Disconnect()
+            return fmt.Errorf("Consumer restart failed: %w", err)
+        }
+        consumerMu.Lock()
+        Consumer = next
+        consumerMu.Unlock()
+        return nil
+    })
+    return sv
+}